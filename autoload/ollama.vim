@@ -16,6 +16,26 @@ let s:kill_job = v:null
 let s:prompt = ''
 " current suggestions
 let s:suggestion = ''
+" all candidates of the last request and the index of the shown one
+let s:candidates = []
+let s:candidate_idx = 0
+" output of a request for multiple candidates, parsed on exit
+let s:output = ''
+" completion cache: maps request keys to {'suggestion': ..., 'time': ...},
+" the suggestion is a list if multiple candidates were requested
+let s:cache = {}
+" cache keys in least recently used order
+let s:cache_lru = []
+" cache key of the running job
+let s:cache_key = ''
+" Ollama model info for complete.py by host and model: the JSON printed by
+" model_info.py, or 0 while it is looked up
+let s:model_info = {}
+" summary of the last completion request for :OllamaDebugInfo
+let s:last_request = {}
+" exit code of complete.py if the model is not installed
+let s:exit_model_not_found = 3
+let s:exit_no_fim_config = 4
 " text property id for ghost text
 let s:prop_id = -1
 " suppress internally trigger reschedules due to inserts
@@ -96,18 +116,103 @@ EOF
     return s:openai_api_key
 endfunction
 
-function! ollama#TriggerCompletion()
+" Requests a completion immediately. The optional argument is a dict of
+" options which override g:ollama_model_options for this request.
+function! ollama#TriggerCompletion(...)
     call ollama#logger#Debug("TriggerCompletion...")
     " get current buffer type
     if &buftype=='prompt'
         call ollama#logger#Debug("Ignoring prompt buffer")
         return
     endif
+    if empty(ollama#CompletionModel())
+        echohl WarningMsg
+        echo "No completion model configured. Run ':Ollama setup' or set g:ollama_model."
+        echohl None
+        return
+    endif
     call s:KillTimer()
     let s:suggestion = ''
     call ollama#UpdatePreview(s:suggestion)
     " directly call GetSuggestion without timer
-    call ollama#GetSuggestion(0)
+    call ollama#GetSuggestion(0, a:0 > 0 ? a:1 : {})
+endfunction
+
+" Implements :OllamaComplete [key=value...]
+function! ollama#Complete(...) abort
+    let l:parsed = ollama#options#Parse(a:000)
+    if l:parsed is v:null
+        return
+    endif
+    let [l:args, l:options] = l:parsed
+    if !empty(l:args)
+        echohl ErrorMsg
+        echom "Usage: OllamaComplete [key=value...]"
+        echohl None
+        return
+    endif
+    call ollama#TriggerCompletion(l:options)
+endfunction
+
+" Returns the reason why completions are suspended, or '' if not. While a
+" macro is recorded or executed, or text is pasted, completions would only
+" cause useless requests, and accepting one would break the macro replay.
+function! s:SuspendReason() abort
+    if !get(g:, 'ollama_suspend_in_macros', 1)
+        return ''
+    endif
+    if reg_executing() != ''
+        return 'executing register ' .. reg_executing()
+    endif
+    if reg_recording() != ''
+        return 'recording register ' .. reg_recording()
+    endif
+    if &paste
+        return "'paste' is set"
+    endif
+    return ''
+endfunction
+
+" max. number of comment lines used for comment-to-code
+let s:max_comment_lines = 20
+
+" Returns the text of the comment above the cursor for comment-to-code, or
+" '' if the cursor is not on a blank line right below a comment. Comments
+" are detected using 'commentstring', consecutive comment lines are joined.
+function! s:CommentBeforeCursor() abort
+    if getline('.') !~# '^\s*$'
+        return ''
+    endif
+    let l:parts = split(&commentstring, '%s', 1)
+    if len(l:parts) != 2 || trim(l:parts[0]) ==# ''
+        return ''
+    endif
+    let l:start = '\V' .. escape(trim(l:parts[0]), '\') .. '\m'
+    let l:end = trim(l:parts[1]) ==# '' ? '' : '\V' .. escape(trim(l:parts[1]), '\') .. '\m'
+    let l:pattern = '^\s*' .. l:start .. '\s*\(.\{-}\)\s*' .. l:end .. '\s*$'
+    let l:lines = []
+    let l:lnum = line('.') - 1
+    while l:lnum > 0 && len(l:lines) < s:max_comment_lines
+        let l:match = matchlist(getline(l:lnum), l:pattern)
+        if empty(l:match)
+            break
+        endif
+        call insert(l:lines, l:match[1])
+        let l:lnum -= 1
+    endwhile
+    return trim(join(l:lines, "\n"))
+endfunction
+
+" Returns 1 if the text before the cursor ends with one of the
+" g:ollama_trigger_chars
+function! s:AfterTriggerChar() abort
+    let l:before = strpart(getline('.'), 0, col('.') - 1)
+    for l:chars in g:ollama_trigger_chars
+        if !empty(l:chars) && l:before[-len(l:chars):] ==# l:chars
+            return 1
+        endif
+    endfor
+    return 0
 endfunction
 
 function! ollama#Schedule()
@@ -125,15 +230,41 @@ function! ollama#Schedule()
         return
     endif
     call s:KillTimer()
+    " The user keeps typing, so a running request is outdated
+    if s:job isnot v:null
+        call ollama#logger#Debug("Cancelling outdated job.")
+        call s:KillJob()
+        let s:prompt = ''
+    endif
     let s:suggestion = ''
     call ollama#UpdatePreview(s:suggestion)
+    let l:reason = s:SuspendReason()
+    if l:reason != ''
+        call ollama#logger#Debug("Completion suspended: " .. l:reason)
+        return
+    endif
+    if g:ollama_trigger_mode ==# 'manual'
+                \ || (g:ollama_trigger_mode ==# 'chars' && !s:AfterTriggerChar())
+        " wait for <Plug>(ollama-trigger-completion) or a trigger character
+        return
+    endif
     call ollama#logger#Debug("Scheduling debounce timer...")
     let s:timer_id = timer_start(g:ollama_debounce_time, 'ollama#GetSuggestion')
 endfunction
 
 " handle output on stdout
-function! s:HandleCompletion(job, data)
+function! s:HandleCompletion(channel, data)
     call ollama#logger#Debug("Received completion: " .. json_encode(a:data))
+    if ch_getjob(a:channel) isnot s:job
+        " output of a cancelled job which is still buffered
+        call ollama#logger#Debug("Ignoring output of outdated job")
+        return
+    endif
+    if g:ollama_completion_candidates > 1
+        " the JSON array of candidates is parsed when the job exits
+        let s:output ..= a:data
+        return
+    endif
     if !empty(a:data)
         "let l:suggestion = join(a:data, "\n")
         let s:suggestion = substitute(a:data, "\r\n", "\n", "g")
@@ -141,10 +272,57 @@ function! s:HandleCompletion(job, data)
     endif
 endfunction
 
+" Shows the candidates received from complete.py
+function! s:SetCandidates(candidates)
+    let s:candidates = map(copy(a:candidates), {_, c -> substitute(c, "\r\n", "\n", "g")})
+    let s:candidate_idx = 0
+    call ollama#UpdatePreview(get(s:candidates, 0, ''))
+endfunction
+
+" Parses the output of a request for multiple candidates. If the output is
+" no JSON array it is used as single suggestion.
+function! s:ParseCandidates(output)
+    try
+        let l:candidates = json_decode(a:output)
+    catch
+        let l:candidates = v:null
+    endtry
+    if type(l:candidates) != v:t_list
+        return empty(a:output) ? [] : [a:output]
+    endif
+    return filter(l:candidates, {_, c -> type(c) == v:t_string && !empty(c)})
+endfunction
+
+" Shows the next (direction 1) or previous (direction -1) candidate
+function! ollama#CycleCandidate(direction)
+    if len(s:candidates) < 2 || s:suggestion !=# s:candidates[s:candidate_idx]
+        " no candidates or the suggestion was partially accepted already
+        return
+    endif
+    let s:candidate_idx = (s:candidate_idx + a:direction + len(s:candidates)) % len(s:candidates)
+    call ollama#UpdatePreview(s:candidates[s:candidate_idx])
+endfunction
+
+" warnings which were shown in this session
+let s:warnings_shown = {}
+
 " handle output on stderr
 function! s:HandleError(job, data)
     call ollama#logger#Debug("Received stderr: " .. a:data)
+    if a:data =~# '^Warning: '
+        " warnings are shown only once, not for every completion
+        if !has_key(s:warnings_shown, a:data)
+            let s:warnings_shown[a:data] = 1
+            echohl WarningMsg
+            echom a:data
+            echohl None
+        endif
+        return
+    endif
     if !empty(a:data)
+        if has_key(s:last_request, 'errors')
+            call add(s:last_request.errors, a:data)
+        endif
         echom "Error: " .. a:data
         call popup_notification(a:data, #{ pos: "center", time: 3000 })
     endif
@@ -152,9 +330,22 @@ endfunction
 
 function! s:HandleExit(job, exit_code)
     call ollama#logger#Debug("Process exited: " .. a:exit_code)
+    let l:failed = a:exit_code != 0 && a:job isnot s:kill_job
+    if a:exit_code == 0 && s:job is a:job
+        if g:ollama_completion_candidates > 1
+            call s:SetCandidates(s:ParseCandidates(s:output))
+            call s:CacheAdd(s:cache_key, s:candidates)
+        else
+            call s:CacheAdd(s:cache_key, s:suggestion)
+        endif
+    endif
     if a:exit_code != 0
         " Don't log errors if we killed the job, this is expected
-        if a:job isnot s:kill_job
+        if a:exit_code == s:exit_model_not_found && a:job isnot s:kill_job
+            call ollama#model#HandleMissingModel(get(s:last_request, 'model', g:ollama_model))
+        elseif a:exit_code == s:exit_no_fim_config && a:job isnot s:kill_job
+            call ollama#model#HandleMissingFimConfig(get(s:last_request, 'model', g:ollama_model))
+        elseif a:job isnot s:kill_job
             echohl ErrorMsg
             echom "Process exited with code: " .. a:exit_code
             if g:ollama_model_provider =~ '^openai'
@@ -169,13 +360,19 @@ function! s:HandleExit(job, exit_code)
             let s:kill_job = v:null
             call ollama#logger#Debug("Process terminated as expected")
         endif
-        call ollama#ClearPreview()
+        if s:job is a:job
+            call ollama#ClearPreview()
+        endif
     endif
     " release reference to job object
     if s:job is a:job
+        let s:last_request.exit_code = a:exit_code
+        let s:last_request.duration = reltimefloat(reltime(s:last_request.start))
+        let s:last_request.response = g:ollama_completion_candidates > 1 ? s:candidates : s:suggestion
         let s:job = v:null
+        let s:prompt = ''
+        call ollama#status#End('completion', l:failed ? 'Completion failed with exit code ' .. a:exit_code : '')
     endif
-    let s:prompt = ''
 endfunction
 
 " Constructs a prompt for the completion request.
@@ -194,35 +391,138 @@ function! s:ConstructPrompt()
         let l:prefix ..= "\n"
     endif
     let l:prefix ..= strpart(getline('.'), 0, l:col - 1)
-    " Combine suffix lines and current line's suffix part
+    " Combine current line's suffix part and suffix lines. The line break
+    " is needed even if the cursor is at the end of the line, otherwise the
+    " model would see the next line as rest of the current one.
     let l:suffix = strpart(getline('.'), l:col - 1)
-    if !empty(l:suffix)
-        let l:suffix ..= "\n"
+    if !empty(l:suffix_lines)
+        let l:suffix ..= "\n" .. join(l:suffix_lines, "\n")
     endif
-    let l:suffix ..= join(l:suffix_lines, "\n")
 
     return l:prefix .. '<FILL_IN_HERE>' .. l:suffix
 endfunction
 
-function! ollama#GetSuggestion(timer)
+" Returns the cached suggestion for the given key or v:null if the key
+" does not exist or the entry has expired.
+function! s:CacheGet(key)
+    if g:ollama_completion_cache_size <= 0 || !has_key(s:cache, a:key)
+        return v:null
+    endif
+    let l:entry = s:cache[a:key]
+    call remove(s:cache_lru, index(s:cache_lru, a:key))
+    if localtime() - l:entry.time > g:ollama_completion_cache_ttl
+        call remove(s:cache, a:key)
+        return v:null
+    endif
+    " mark as most recently used
+    call add(s:cache_lru, a:key)
+    return l:entry.suggestion
+endfunction
+
+" Adds a suggestion to the cache and evicts the least recently used entries
+function! s:CacheAdd(key, suggestion)
+    if g:ollama_completion_cache_size <= 0 || empty(a:key) || empty(a:suggestion)
+        return
+    endif
+    if has_key(s:cache, a:key)
+        call remove(s:cache_lru, index(s:cache_lru, a:key))
+    endif
+    let s:cache[a:key] = {'suggestion': a:suggestion, 'time': localtime()}
+    call add(s:cache_lru, a:key)
+    while len(s:cache_lru) > g:ollama_completion_cache_size
+        call remove(s:cache, remove(s:cache_lru, 0))
+    endwhile
+endfunction
+
+" Returns the model info arguments for complete.py. The info is looked up
+" once per model in the background, until it is available complete.py
+" requests it itself.
+function! s:ModelInfoArgs(model) abort
+    let l:key = g:ollama_host .. "\n" .. a:model
+    let l:info = get(s:model_info, l:key, v:null)
+    if type(l:info) == v:t_string
+        return ['-M', l:info]
+    endif
+    if l:info is v:null
+        let s:model_info[l:key] = 0
+        let l:command = [ g:ollama_python_interpreter,
+                    \ g:ollama_plugin_dir .. '/python/model_info.py',
+                    \ '-u', g:ollama_host,
+                    \ '-m', a:model ] + ollama#connection#Args()
+        call ollama#logger#Debug("Model info command=" .. join(l:command, ' '))
+        let l:output = []
+        call job_start(l:command, {
+                    \ 'out_cb': {ch, msg -> add(l:output, msg)},
+                    \ 'err_cb': {ch, msg -> ollama#logger#Debug('model_info: ' .. msg)},
+                    \ 'close_cb': function('s:ModelInfoDone', [l:key, l:output]),
+                    \ })
+    endif
+    return []
+endfunction
+
+" Called when all output of model_info.py was read. It prints nothing on
+" stdout if the lookup failed.
+function! s:ModelInfoDone(key, output, channel) abort
+    if !empty(a:output)
+        call ollama#logger#Debug("Model info: " .. a:output[0])
+        let s:model_info[a:key] = a:output[0]
+    else
+        " try again with the next completion
+        call remove(s:model_info, a:key)
+    endif
+endfunction
+
+" Returns the files of the most recently used buffers, which are used as
+" additional context for the completion request.
+function! s:GetContextFiles(count)
+    let l:project = ollama#project#Config()
+    let l:buffers = filter(getbufinfo({'buflisted': 1}), {_, buf ->
+          \ buf.bufnr != bufnr('%')
+          \ && getbufvar(buf.bufnr, '&buftype') == ''
+          \ && filereadable(buf.name)
+          \ && !ollama#project#IsIgnored(buf.name, l:project)})
+    " most recently used buffers first
+    call sort(l:buffers, {a, b -> b.lastused - a.lastused})
+    let l:buffers = l:buffers[: a:count - 1]
+    return map(l:buffers, {_, buf -> fnamemodify(buf.name, ':.')})
+endfunction
+
+function! ollama#GetSuggestion(timer, ...)
     call ollama#logger#Debug("GetSuggestion")
     " reset timer handle when called
     let s:timer_id = -1
+    let l:model = ollama#CompletionModel()
+    if empty(l:model)
+        call ollama#logger#Debug("No completion model configured")
+        return
+    endif
+    " a macro may have been started while the timer was running
+    let l:reason = s:SuspendReason()
+    if l:reason != ''
+        call ollama#logger#Debug("Completion suspended: " .. l:reason)
+        return
+    endif
 
     let l:prompt = s:ConstructPrompt()
 
-    " Clone global model options and add the current filetype
-    let l:model_options_dict = copy(g:ollama_model_options)
+    " Clone global model options, apply the overrides and add the current filetype
+    let l:model_options_dict = extend(copy(g:ollama_model_options), ollama#project#Get('model_options', {}))
+    if type(g:ollama_completion_seed) == v:t_number
+        " reproducible completions for debugging
+        let l:model_options_dict.seed = g:ollama_completion_seed
+        let l:model_options_dict.temperature = 0
+    endif
+    call extend(l:model_options_dict, a:0 > 0 ? a:1 : {})
     let l:model_options_dict['lang'] = &filetype
 
     let l:model_options =
           \ substitute(json_encode(l:model_options_dict), "\"", "\\\"", "g")
     call ollama#logger#Debug(
           \ "Connecting to Ollama on " .. g:ollama_host
-          \ .. " using model " .. g:ollama_model)
+          \ .. " using model " .. l:model)
     call ollama#logger#Debug("model_options=" .. l:model_options)
     " Convert plugin debug level to python logger levels
-    let l:log_level = ollama#logger#PythonLogLevel(g:ollama_debug)
+    let l:log_level = ollama#logger#PythonLogLevel(ollama#logger#Level())
     let l:base_url = g:ollama_host
     if g:ollama_model_provider =~ '^openai'
         let l:base_url = g:ollama_openai_baseurl
@@ -231,11 +531,14 @@ function! ollama#GetSuggestion(timer)
     let l:command = [ g:ollama_python_interpreter,
         \ g:ollama_plugin_dir .. "/python/complete.py",
         \ "-p", g:ollama_model_provider,
-        \ "-m", g:ollama_model,
+        \ "-m", l:model,
         \ "-u", l:base_url,
         \ "-o", l:model_options,
-        \ "-l", l:log_level
-        \ ]
+        \ "-x", g:ollama_max_num_ctx,
+        \ "-n", g:ollama_completion_candidates,
+        \ "-l", l:log_level,
+        \ "--reasoning-delimiters", json_encode(g:ollama_reasoning_delimiters)
+        \ ] + ollama#model#KeepAliveArgs('-K') + ollama#connection#Args()
     " Add optional credentialname for looking up the API key
     if g:ollama_model_provider =~ '^openai'
         if g:ollama_openai_credentialname != ''
@@ -248,6 +551,37 @@ function! ollama#GetSuggestion(timer)
             let l:command += [ '-k', g:ollama_mistral_credentialname ]
         endif
     endif
+    " Add user FIM configs
+    if !empty(g:ollama_fim_config_dir)
+        let l:command += [ '-C', expand(g:ollama_fim_config_dir) ]
+    endif
+    if !g:ollama_fim_fallback
+        let l:command += [ '-F' ]
+    endif
+    if g:ollama_completion_suffix_hint
+        let l:command += [ '-S' ]
+    endif
+    if g:ollama_model_provider ==# 'ollama'
+        let l:command += s:ModelInfoArgs(l:model)
+    endif
+    " Ask to implement the comment above the cursor instead of FIM
+    let l:comment = g:ollama_comment_to_code ? s:CommentBeforeCursor() : ''
+    if l:comment != ''
+        let l:command += [ '-I', l:comment ]
+    endif
+    " Add content of other files as context. complete.py reads them from
+    " disk, so their modification times go into the cache key.
+    let l:context_files = ollama#project#Get('context_files', g:ollama_context_files)
+    let l:context = ''
+    if l:context_files > 0
+        for l:file in s:GetContextFiles(l:context_files)
+            let l:command += [ '-c', l:file ]
+            let l:context ..= l:file .. ':' .. getftime(l:file) .. ':' .. getfsize(l:file) .. "\n"
+        endfor
+        let l:budget = ollama#project#Get('context_budget', g:ollama_context_budget)
+        let l:command += [ '-b', l:budget ]
+        let l:context ..= l:budget
+    endif
     call ollama#logger#Debug("command=" .. join(l:command, " "))
     let l:job_options = {
         \ 'out_mode': 'raw',
@@ -271,6 +605,34 @@ function! ollama#GetSuggestion(timer)
               \ .. " Already running.")
         return
     endif
+
+    " Check if we got the same request before
+    let l:cache_key = g:ollama_model_provider .. "\n" .. l:model
+          \ .. "\n" .. l:model_options .. "\n" .. g:ollama_completion_candidates
+          \ .. "\n" .. l:comment .. "\n" .. l:context .. "\n" .. l:prompt
+    let l:suggestion = s:CacheGet(l:cache_key)
+    if l:suggestion isnot v:null
+        call ollama#logger#Debug("Using cached completion for '" .. l:prompt .. "'.")
+        if s:job isnot v:null
+            call s:KillJob()
+        endif
+        let s:prompt = ''
+        if type(l:suggestion) == v:t_list
+            call s:SetCandidates(l:suggestion)
+        else
+            call ollama#UpdatePreview(l:suggestion)
+        endif
+        return
+    endif
+    " wait for a free slot and space out the requests, the timer gets
+    " restarted by the next keystroke, so the newest request wins
+    let l:delay = ollama#throttle#CompletionDelay()
+    if l:delay > 0
+        let l:overrides = a:000
+        let s:timer_id = timer_start(l:delay, {t -> call('ollama#GetSuggestion', [t] + l:overrides)})
+        return
+    endif
+    let s:cache_key = l:cache_key
     " save current search
     let s:prompt = l:prompt
 
@@ -280,9 +642,24 @@ function! ollama#GetSuggestion(timer)
         call s:KillJob()
     endif
 
+    let s:output = ''
+    let s:candidates = []
     call ollama#logger#Debug("Starting job for '" .. l:prompt .. "'...")
     " create job object and hold reference to avoid closing channels
     let s:job = job_start(l:command, l:job_options)
+    let s:last_request = {
+        \ 'time': strftime('%Y-%m-%d %H:%M:%S'),
+        \ 'start': reltime(),
+        \ 'provider': g:ollama_model_provider,
+        \ 'model': l:model,
+        \ 'url': l:base_url,
+        \ 'options': l:model_options_dict,
+        \ 'prompt': l:prompt,
+        \ 'comment': l:comment,
+        \ 'errors': [],
+        \ }
+    call ollama#status#Begin('completion')
+    call ollama#throttle#CompletionStarted()
     let channel = job_getchannel(s:job)
     call ch_sendraw(channel, l:prompt)
     call ch_close_in(channel)
@@ -300,6 +677,9 @@ function! ollama#UpdatePreview(suggestion)
             return ollama#ClearPreview()
         endif
         let annot= ''
+        if len(s:candidates) > 1 && s:suggestion ==# s:candidates[s:candidate_idx]
+            let annot = printf('(%d/%d)', s:candidate_idx + 1, len(s:candidates))
+        endif
         call ollama#ClearPreview()
         call prop_add(line('.'), col('.'), {'type': s:hlgroup, 'text': text[0]})
         for line in text[1:]
@@ -329,6 +709,10 @@ function! s:KillJob()
             call ollama#logger#Debug("Killing existing job.")
             let s:kill_job = s:job
             call job_stop(s:job, "kill")
+            " release the job, so that its exit doesn't clear the preview of
+            " a newer suggestion
+            let s:job = v:null
+            call ollama#status#End('completion')
         endif
     catch
         call ollama#logger#Error("KillJob failed")
@@ -341,6 +725,7 @@ function! s:KillTimer()
             call ollama#logger#Debug("Killing existing timer.")
             call timer_stop(s:timer_id)
             let s:timer_id = -1
+            call ollama#throttle#CompletionDropped()
         endif
     catch
         call ollama#logger#Error("KillTimer failed")
@@ -352,6 +737,7 @@ function! ollama#Clear() abort
     call s:KillTimer()
     call s:KillJob()
     call ollama#ClearPreview()
+    let s:prompt = ''
     let s:suggestion = ''
 endfunction
 
@@ -408,10 +794,63 @@ function! ollama#InsertStringWithNewlines(text, morelines)
     endif
 endfunction
 
+" Characters which autopair plugins insert after the cursor
+let s:closers = ')\]}"''`'
+let s:bracket_pairs = {')': '(', ']': '[', '}': '{'}
+
+" Returns 1 if the closing characters in a:suffix are not matched by an
+" opening one in a:text, i.e. they close something before the cursor.
+function! s:IsUnbalanced(text, suffix) abort
+    for l:char in uniq(sort(split(a:suffix, '\zs')))
+        let l:needed = count(a:suffix, l:char)
+        if has_key(s:bracket_pairs, l:char)
+            let l:excess = count(a:text, l:char) - count(a:text, s:bracket_pairs[l:char])
+            if l:excess < l:needed
+                return 0
+            endif
+        elseif l:needed > 1 || count(a:text, l:char) % 2 == 0
+            " quotes: an odd number means one is unmatched
+            return 0
+        endif
+    endfor
+    return 1
+endfunction
+
+" Removes closing brackets and quotes at the end of the text, which are
+" already in the buffer after the cursor, e.g. inserted by an autopair
+" plugin. The closers may be on a later line, when the rest of the current
+" line is blank. Does nothing if g:ollama_skip_duplicate_closers is off.
+function! s:SkipDuplicateClosers(text) abort
+    if !get(g:, 'ollama_skip_duplicate_closers', 0)
+        return a:text
+    endif
+    let l:after = strpart(getline('.'), col('.') - 1)
+    let l:same_line = l:after =~ '\S'
+    let l:lnum = line('.') + 1
+    while l:after !~ '\S' && l:lnum <= line('$')
+        let l:after ..= "\n" .. getline(l:lnum)
+        let l:lnum += 1
+    endwhile
+    let l:present = matchstr(l:after, '^\_s*\zs[' .. s:closers .. ']\+')
+    let l:text = substitute(a:text, '\_s*$', '', '')
+    let l:trailing = matchstr(l:text, '[' .. s:closers .. ']\+$')
+    " longest trailing part of the suggestion which is already present
+    for l:k in range(min([len(l:trailing), len(l:present)]), 1, -1)
+        let l:suffix = strpart(l:trailing, len(l:trailing) - l:k)
+        if l:suffix ==# strpart(l:present, 0, l:k) && s:IsUnbalanced(l:text, l:suffix)
+            call ollama#logger#Debug("Skipping duplicate closers: " .. l:suffix)
+            let l:result = strpart(l:text, 0, len(l:text) - l:k)
+            " the closer on a later line makes the line break obsolete
+            return l:same_line ? l:result : substitute(l:result, '\_s*$', '', '')
+        endif
+    endfor
+    return a:text
+endfunction
+
 function! ollama#InsertSuggestion()
     call ollama#logger#Debug("InsertSuggestion")
     if !empty(s:suggestion)
-        call ollama#InsertStringWithNewlines(s:suggestion, 0)
+        call ollama#InsertStringWithNewlines(s:SkipDuplicateClosers(s:suggestion), 0)
 
         " all was inserted so we can clear the current suggestion
         call ollama#ClearPreview()
@@ -424,6 +863,12 @@ function! ollama#InsertSuggestion()
     return '\t'
 endfunction
 
+" Starts a new undo block, so each partial accept can be undone separately
+" and is not joined with the text typed before or after.
+function! s:BreakUndo()
+    let &undolevels = &undolevels
+endfunction
+
 function! ollama#InsertNextLine()
     call ollama#logger#Debug("> InsertNextLine")
     if empty(s:suggestion)
@@ -448,9 +893,14 @@ function! ollama#InsertNextLine()
     else
         let morelines=1
     endif
+    if !morelines
+        let l:firstline = s:SkipDuplicateClosers(l:firstline)
+    endif
 
     let s:ignore_schedule = 1
+    call s:BreakUndo()
     call ollama#InsertStringWithNewlines(l:firstline, morelines)
+    call s:BreakUndo()
 
     " update preview with remain suggestion
     call ollama#UpdatePreview(s:suggestion)
@@ -473,30 +923,60 @@ function! ollama#InsertNextWord()
     let s:suggestion = strpart(s:suggestion, strlen(l:text)) " remove word from suggestion
     call ollama#logger#Debug("firstword=" .. json_encode(l:firstword))
     call ollama#logger#Debug("new suggestion=" .. json_encode(s:suggestion))
+    if matchstr(s:suggestion, '\S') == ""
+        " last word
+        let l:firstword = s:SkipDuplicateClosers(l:firstword)
+    endif
 
     let s:ignore_schedule = 1
+    call s:BreakUndo()
     call ollama#InsertStringWithNewlines(l:firstword, 0)
+    call s:BreakUndo()
 
     " update preview with remain suggestion
     call ollama#UpdatePreview(s:suggestion)
     call ollama#logger#Debug("< InsertNextWord")
 endfunction
 
-function ollama#IsEnabled() abort
+" Returns the completion model of the current buffer: the model of the
+" project config, or g:ollama_model
+function! ollama#CompletionModel() abort
+    return ollama#project#Get('model', g:ollama_model)
+endfunction
+
+" Returns the summary of the last completion request, an empty dict if
+" there was none. The keys 'exit_code', 'duration' and 'response' are
+" missing while the request is running or if it was cancelled.
+function! ollama#LastRequest() abort
+    return deepcopy(s:last_request)
+endfunction
+
+" Returns 1 if completions are enabled for the buffer (default: current
+" buffer)
+function ollama#IsEnabled(...) abort
+    let l:buf = a:0 > 0 ? a:1 : bufnr('')
     " Check if the global setting is enabled
     if exists('g:ollama_enabled') && g:ollama_enabled == 0
         return 0
     endif
 
-    " Check if the buffer-local variable is set and disables completion
-    if exists('b:ollama_enabled') && b:ollama_enabled == 0
+    " The buffer-local variable overrides the filetype lists
+    let l:enabled = getbufvar(l:buf, 'ollama_enabled', v:null)
+    if l:enabled isnot v:null
+        return l:enabled
+    endif
+
+    " The project config overrides the filetype lists
+    let l:project = ollama#project#Config(l:buf)
+    if !get(l:project, 'enabled', 1) || ollama#project#IsIgnored(bufname(l:buf), l:project)
         return 0
     endif
 
+    let l:filetype = getbufvar(l:buf, '&filetype')
     " Denylist check: disables even if allowlist allows it
     if exists('g:ollama_completion_denylist_filetype')
                 \ && len(g:ollama_completion_denylist_filetype) > 0
-                \ && index(g:ollama_completion_denylist_filetype, &filetype) >= 0
+                \ && index(g:ollama_completion_denylist_filetype, l:filetype) >= 0
         " file is in deny list -> disabled
         return 0
     endif
@@ -504,7 +984,7 @@ function ollama#IsEnabled() abort
     " Allowlist check: enable only if in allowlist
     if exists('g:ollama_completion_allowlist_filetype')
                 \ && len(g:ollama_completion_allowlist_filetype) > 0
-                \ && index(g:ollama_completion_allowlist_filetype, &filetype) < 0
+                \ && index(g:ollama_completion_allowlist_filetype, l:filetype) < 0
         " allow list exists, but file is not listed -> disable
         return 0
     endif
@@ -538,6 +1018,22 @@ function ollama#Toggle() abort
     endif
 endfunction
 
+" Toggles completions for the current buffer. Only the buffer setting is
+" toggled, so the global setting doesn't flip it back and forth.
+function ollama#ToggleBuffer() abort
+    let b:ollama_enabled = !get(b:, 'ollama_enabled', 1)
+    if !b:ollama_enabled
+        call ollama#Clear()
+    endif
+    if exists('g:ollama_enabled') && g:ollama_enabled == 0
+        echohl WarningMsg
+        echo "Vim-Ollama is " .. (b:ollama_enabled ? "enabled" : "disabled") .. " for this buffer, but completions are disabled globally. Use ':Ollama enable' to turn them on."
+        echohl None
+    else
+        echo "Vim-Ollama is " .. (b:ollama_enabled ? "enabled" : "disabled") .. " for this buffer."
+    endif
+endfunction
+
 " Provide different commands: enable, disable, help, etc.
 function ollama#Command(command) abort
     if a:command == 'setup'
@@ -550,14 +1046,16 @@ function ollama#Command(command) abort
         call ollama#Disable()
     elseif a:command == 'toggle'
         call ollama#Toggle()
+    elseif a:command == 'togglebuffer'
+        call ollama#ToggleBuffer()
     elseif a:command == 'pipinstall'
         call ollama#setup#PipInstall()
     else
-        echo "Usage: Ollama <setup|config|enable|disable|toggle|pipinstall>"
+        echo "Usage: Ollama <setup|config|enable|disable|toggle|togglebuffer|pipinstall>"
     endif
 endfunction
 
 " Define the available commands for completion
 function! ollama#CommandComplete(ArgLead, CmdLine, CursorPos)
-    return ['setup', 'config', 'enable', 'disable', 'toggle', 'pipinstall']
+    return ['setup', 'config', 'enable', 'disable', 'toggle', 'togglebuffer', 'pipinstall']
 endfunction
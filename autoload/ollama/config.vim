@@ -15,25 +15,62 @@ let s:help_text = {
 \ 'ollama_mistral_credentialname': 'Credential name to lookup the Mistral API key in password store',
 \ 'ollama_openai_baseurl': 'OpenAI base URL (default='', which uses the official OpenAI API).',
 \ 'ollama_openai_credentialname': 'Credential name to lookup OpenAI API key in password store',
+\ 'ollama_statusline_spinner': 'Animate the statusline indicator while requests are pending (default=1)',
+\ 'ollama_ca_bundle': 'CA bundle for verifying the certificate of the Ollama server',
+\ 'ollama_tls_insecure': 'Do not verify the certificate of the Ollama server (default=0)',
+\ 'ollama_auth': 'Authorization header for the Ollama server: bearer, basic or empty (default)',
+\ 'ollama_connect_timeout': 'Timeout in seconds for connecting to the Ollama server (default=10)',
+\ 'ollama_retries': 'Number of retries on connection errors and busy servers (default=2)',
+\ 'ollama_max_concurrent_requests': 'Max. number of requests in flight, 0 means unlimited (default=0)',
+\ 'ollama_completion_rate_limit': 'Max. number of completion requests per minute, 0 means unlimited (default=0)',
+\ 'ollama_auth_credentialname': 'Credential name to lookup the Ollama token in password store',
 \ 'ollama_model_provider': 'Provider for code completions: "ollama", "mistral", "openai" or "openai_legacy".',
 \ 'ollama_model': 'Default model for <tab> completions.',
 \ 'ollama_model_options': 'Options for model customization.',
+\ 'ollama_fim_config_dir': 'Directory with user FIM configs, which override the built-in configs',
+\ 'ollama_fim_fallback': 'Use Ollama''s template or prefix-only completion for models without FIM config (default=1)',
+\ 'ollama_completion_suffix_hint': 'Add the code after the cursor as hint for models without FIM support (default=0)',
+\ 'ollama_skip_duplicate_closers': 'Don''t insert closing brackets and quotes which are already after the cursor (default=0)',
+\ 'ollama_suspend_in_macros': 'No completions while recording or executing macros and in paste mode (default=1)',
+\ 'ollama_warmup': 'Load the completion model in the background when Vim starts (default=0)',
+\ 'ollama_keep_alive': 'How long Ollama keeps the completion model loaded, e.g. 1800 or ''30m'' (default='''')',
+\ 'ollama_comment_to_code': 'Ask the model to implement the comment above the cursor on a blank line (default=0)',
+\ 'ollama_completion_seed': 'Seed for reproducible completions, also sets temperature to 0 (default='''')',
+\ 'ollama_reasoning_delimiters': 'Start and end delimiters of reasoning blocks, which are stripped from responses (default=[[''<think>'', ''</think>'']])',
+\ 'ollama_max_num_ctx': 'Upper bound for the automatically computed num_ctx (default=8192).',
 \ 'ollama_context_lines': 'Number of context lines to consider (default=10).',
+\ 'ollama_project_config': 'Name of the project config file, searched upwards from the buffer (default=''.ollama.json'').',
+\ 'ollama_context_files': 'Number of recently used files added as context (default=0).',
+\ 'ollama_context_budget': 'Max. number of bytes read from context files (default=4096).',
 \ 'ollama_debounce_time': 'Debounce time for completions in [ms] (default=500).',
+\ 'ollama_trigger_mode': 'When completions are requested: "auto", "chars" or "manual" (default="auto").',
+\ 'ollama_trigger_chars': 'Characters which trigger completions in "chars" mode.',
+\ 'ollama_pull_missing_model': 'Pull a missing completion model: "ask", "always" or "never" (default="ask").',
+\ 'ollama_completion_candidates': 'Number of completion candidates to cycle through (default=1).',
+\ 'ollama_completion_cache_size': 'Max. number of cached completions, 0 disables the cache (default=100).',
+\ 'ollama_completion_cache_ttl': 'Time in seconds until a cached completion expires (default=300).',
 \ 'ollama_completion_allowlist_filetype':
 \     'Only run compltion for these filetypes (default=[]).',
 \ 'ollama_completion_denylist_filetype':
-\     'Do not run compltion for these filetypes (default=[]).',
+\     'Do not run compltion for these filetypes (default=["gitcommit", "gitrebase", "help"]).',
 \ 'ollama_chat_provider': 'Provider for code conversations: "ollama" or "openai".',
 \ 'ollama_chat_model': 'Model used for chat interactions.',
 \ 'ollama_chat_systemprompt': 'System prompt for chat context.',
+\ 'ollama_chat_systemprompt_file': 'Project file in the working directory or its parents which overrides the system prompt (default=.ollama-systemprompt).',
 \ 'ollama_chat_options': 'Chat model customization options.',
 \ 'ollama_chat_timeout': 'Timeout for chat responses in seconds (default=10).',
+\ 'ollama_chat_use_terminal': 'Run the chat in a terminal window if Vim has +terminal (default=0).',
+\ 'ollama_chat_stats': 'Show token and timing statistics after each chat response (default=0).',
+\ 'ollama_chat_reasoning': 'Reasoning of reasoning models in the chat: "show", "fold" or "hide" (default="fold").',
+\ 'ollama_chat_history': 'Save chat conversations per project for :OllamaChatRestore (default=1).',
+\ 'ollama_chat_history_dir': 'Directory of the chat history files.',
+\ 'ollama_chat_attach_budget': 'Max. characters attached to the chat by :OllamaAttach (default=16000).',
 \ 'ollama_edit_provider': 'Provider for edit tasks: "ollama" or "openai".',
 \ 'ollama_edit_model': 'Model used for text editing.',
 \ 'ollama_edit_options': 'Options for edit model.',
 \ 'ollama_use_inline_diff': 'Use inline diff for edits (default=1).',
-\ 'ollama_debug': 'Enable debug logging (0=Off, 1=Errors, 2=Warnings, 3=Info, 4=Debug, default=0).',
+\ 'ollama_debug': 'Enable debug logging (0=Off, 1=Errors, 2=Warnings, 3=Info, 4=Debug, or a level name like ''info'', default=0).',
+\ 'ollama_log_max_size': 'Maximum size of the log file in bytes before it gets rotated (0=unlimited, default=1048576).',
 \ 'ollama_logfile': 'Logfile path for debugging.',
 \ 'ollama_review_logfile': 'Review-specific logfile path.',
 \ 'ollama_no_maps': 'Disable default mappings for Ollama plugs (default=0).',
@@ -73,10 +110,11 @@ function! ollama#config#FetchModels(type) abort
         return
     endif
     " Convert plugin debug level to python logger levels
-    let l:log_level = ollama#logger#PythonLogLevel(g:ollama_debug)
+    let l:log_level = ollama#logger#PythonLogLevel(ollama#logger#Level())
 
     echo "baseurl="..l:baseurl
     let l:command = [ g:ollama_python_interpreter, l:script_path, '-u', l:baseurl, '-p', l:provider, '-l', l:log_level]
+    let l:command += ollama#connection#Args()
     " Add optional credentialname for looking up the API key
     if g:ollama_model_provider =~ '^openai'
         if g:ollama_openai_credentialname != ''
@@ -0,0 +1,36 @@
+" SPDX-License-Identifier: GPL-3.0-or-later
+" SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
+"
+" TLS and authentication settings for Ollama servers behind a reverse proxy.
+scriptencoding utf-8
+
+" Returns the command line options of the connection settings.
+" These are understood by all python scripts (see OllamaConnection.py).
+function! ollama#connection#Args() abort
+    let l:args = ['--connect-timeout', g:ollama_connect_timeout, '--retries', g:ollama_retries]
+    if !empty(g:ollama_ca_bundle)
+        let l:args += ['--ca-bundle', expand(g:ollama_ca_bundle)]
+    endif
+    if g:ollama_tls_insecure
+        let l:args += ['--insecure']
+    endif
+    if !empty(g:ollama_auth)
+        let l:args += ['--auth', g:ollama_auth]
+        if !empty(g:ollama_auth_credentialname)
+            let l:args += ['--auth-keyname', g:ollama_auth_credentialname]
+        endif
+    endif
+    return l:args
+endfunction
+
+" Returns the connection settings for the in-process CodeEditor
+function! ollama#connection#Settings() abort
+    return {
+        \ 'ca_bundle': expand(g:ollama_ca_bundle),
+        \ 'insecure': g:ollama_tls_insecure,
+        \ 'auth': g:ollama_auth,
+        \ 'auth_keyname': g:ollama_auth_credentialname,
+        \ 'connect_timeout': g:ollama_connect_timeout,
+        \ 'retries': g:ollama_retries,
+        \ }
+endfunction
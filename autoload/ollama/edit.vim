@@ -22,6 +22,7 @@ function! ollama#edit#EditCodeDone(status)
     let b:popup = 0
     " reset status
     let g:edit_in_progress = 0
+    call ollama#status#End('edit')
     redraw!
 endfunction
 
@@ -45,6 +46,28 @@ finally:
 EOF
 endfunction
 
+" Applies the refactoring when the user confirmed the diff
+function! ollama#edit#ReplaceCallback(id, result)
+    if a:result != 1
+        echo 'Refactoring discarded.'
+        return
+    endif
+    python3 << EOF
+import vim
+try:
+    if CodeEditor.ReplaceSelection():
+        vim.command("echo 'Applied changes. Use u to undo them.'")
+    else:
+        vim.command('echohl WarningMsg')
+        vim.command('echom "The lines were changed while waiting for the response, the refactoring was not applied."')
+        vim.command('echohl None')
+except Exception as e:
+    vim.command('echohl ErrorMsg')
+    vim.command('echom "Error applying changes: ' + str(e).replace('"', "'") + '"')
+    vim.command('echohl None')
+EOF
+endfunction
+
 " Give user visual feedback about job that is in progress
 function! ollama#edit#UpdateProgress(popup)
     " Cycle through progress states
@@ -73,7 +96,9 @@ try:
             vim.command('call popup_notification("'+errormsg+'", #{ pos: "center"})')
         else:
             if groups:
-                if use_inline_diff:
+                if CodeEditor.g_replace:
+                    CodeEditor.ShowReplaceDialog("ollama#edit#ReplaceCallback")
+                elif use_inline_diff:
                     CodeEditor.ShowAcceptDialog("ollama#edit#DialogCallback", 0)
                 else:
                     vim.command("echo 'Applied changes.'")
@@ -96,12 +121,14 @@ endfunction
 """""""""""""""""""""""""""""""""""""""""""""""""""""""""""
 " Internal Helper function for offloading logic to Python
 """""""""""""""""""""""""""""""""""""""""""""""""""""""""""
-function! s:EditCodeInternal(request, first_line, last_line) abort
+function! s:EditCodeInternal(request, first_line, last_line, ...) abort
+    let l:replace = a:0 > 0 ? a:1 : 0
     if exists('g:edit_in_progress') && g:edit_in_progress
         return
     endif
     let l:model_options = substitute(json_encode(g:ollama_edit_options), "\"", "\\\"", "g")
-    let l:log_level = ollama#logger#PythonLogLevel(g:ollama_debug)
+    let l:log_level = ollama#logger#PythonLogLevel(ollama#logger#Level())
+    let l:connection = ollama#connection#Settings()
 
     " Call the python code to edit the code via Ollama.
     " The python code starts a worker thread so that the GUI stays responsive
@@ -114,6 +141,7 @@ request = vim.eval('a:request')
 firstline = vim.eval('a:first_line')
 lastline = vim.eval('a:last_line')
 log_level = int(vim.eval('l:log_level'))
+replace = bool(int(vim.eval('l:replace')))
 baseurl = vim.eval('g:ollama_host')
 provider = vim.eval('g:ollama_edit_provider')
 credentialname = None
@@ -128,11 +156,13 @@ settings = {
     'url': baseurl,
     'provider': provider,
     'model': vim.eval('g:ollama_edit_model'),
-    'options': vim.eval('l:model_options')
+    'options': vim.eval('l:model_options'),
+    'reasoning_delimiters': vim.eval('g:ollama_reasoning_delimiters')
 }
+settings.update(vim.eval('l:connection'))
 CodeEditor.SetLogLevel(log_level)
 # Now pass these settings to the CodeEditor function
-CodeEditor.start_vim_edit_code(request, firstline, lastline, settings, credentialname)
+CodeEditor.start_vim_edit_code(request, firstline, lastline, settings, credentialname, replace)
 EOF
 
     " Create a floating window for progress
@@ -149,6 +179,8 @@ EOF
     let b:popup = l:popup
     let g:progress_indicator = 0
     let g:edit_in_progress = 1
+    " edits are not queued, but count as requests in flight for throttle.vim
+    call ollama#status#Begin('edit')
 
     " Set up a timer to check progress periodically
     let b:timer = timer_start(100, { -> ollama#edit#UpdateProgress(l:popup) }, {'repeat': -1})
@@ -180,6 +212,21 @@ function! ollama#edit#EditPrompt() range
     call s:EditCodeInternal(l:prompt, a:firstline, a:lastline)
 endfunction
 
+"""""""""""""""""""""""""""""""""""""""""""""""""""""""""""
+" Refactor the range: the result replaces the lines after
+" confirming the diff (Range command)
+"""""""""""""""""""""""""""""""""""""""""""""""""""""""""""
+function! ollama#edit#Refactor(request) range
+    let l:request = a:request
+    if empty(l:request)
+        let l:request = input('Refactor: ')
+        if empty(l:request)
+            return
+        endif
+    endif
+    call s:EditCodeInternal(l:request, a:firstline, a:lastline, 1)
+endfunction
+
 """""""""""""""""""""""""""""""""""""""""""""""""""""""""""
 " Accept All Changes
 """""""""""""""""""""""""""""""""""""""""""""""""""""""""""
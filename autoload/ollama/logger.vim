@@ -9,7 +9,25 @@ endif
 if !exists('g:ollama_debug')
     let g:ollama_debug = 0
 endif
+if !exists('g:ollama_log_max_size')
+    let g:ollama_log_max_size = 1048576
+endif
 let s:logs = []
+" log level names which can be used instead of numbers in g:ollama_debug
+let s:level_names = {'off': 0, 'error': 1, 'warn': 2, 'warning': 2, 'info': 3, 'debug': 4}
+" interval for refreshing a tailed log file [ms]
+let s:tail_interval = 1000
+let s:tail_timer = -1
+
+" Returns the numeric log level of g:ollama_debug, which can also be set
+" to a level name like 'info'.
+function! ollama#logger#Level() abort
+  let l:level = get(g:, 'ollama_debug', 0)
+  if type(l:level) == v:t_string && l:level !~# '^\d\+$'
+    return get(s:level_names, tolower(l:level), 0)
+  endif
+  return str2nr(l:level)
+endfunction
 
 function! ollama#logger#PythonLogLevel(level) abort
   " Map plugin's log levels to Python numeric logging levels
@@ -50,7 +68,44 @@ endfunction
 
 let s:level_prefixes = ['', '[ERROR] ', '[WARN] ', '[INFO] ', '[DEBUG] ', '[DEBUG] ']
 
+" Refreshes all windows showing the tailed log file and scrolls them to the
+" end. The timer stops itself when the log file is not shown anymore.
+function! s:TailLog(timer) abort
+  let l:bufnr = bufnr(g:ollama_logfile)
+  if l:bufnr <= 0 || empty(win_findbuf(l:bufnr))
+    call timer_stop(a:timer)
+    let s:tail_timer = -1
+    return
+  endif
+  silent! execute 'checktime' l:bufnr
+  for l:winid in win_findbuf(l:bufnr)
+    call win_execute(l:winid, 'normal! G')
+  endfor
+endfunction
+
+" Opens the log file in a split window and follows new log lines
+function! s:OpenLogFile() abort
+  let l:bufnr = bufnr(g:ollama_logfile)
+  let l:winids = l:bufnr > 0 ? win_findbuf(l:bufnr) : []
+  if !empty(l:winids)
+    call win_gotoid(l:winids[0])
+  else
+    execute 'split' fnameescape(g:ollama_logfile)
+  endif
+  setlocal autoread nomodifiable noswapfile
+  normal! G
+  if s:tail_timer == -1
+    let s:tail_timer = timer_start(s:tail_interval, function('s:TailLog'), {'repeat': -1})
+  endif
+endfunction
+
 function! OllamaOpenLogBuffer() abort
+  " Prefer the log file, the buffer is only used when it is not writable
+  if filewritable(g:ollama_logfile)
+    call s:OpenLogFile()
+    return
+  endif
+
   " Check if the buffer already exists
   let l:bufnr = bufnr('ollama:///log')
 
@@ -98,9 +153,23 @@ function! ollama#logger#ToBuffer(lines) abort
   endif
 endfunction
 
+" Renames the log file to '<logfile>.1' when it exceeds
+" g:ollama_log_max_size bytes, so it doesn't grow unbounded.
+" Only one old log file is kept.
+function! s:RotateFile() abort
+  if g:ollama_log_max_size <= 0 || getfsize(g:ollama_logfile) < g:ollama_log_max_size
+    return
+  endif
+  let l:backup = g:ollama_logfile .. '.1'
+  call delete(l:backup)
+  if rename(g:ollama_logfile, l:backup) == 0
+    call writefile([], g:ollama_logfile)
+  endif
+endfunction
+
 " Raw logging function used by all log levels
 function! ollama#logger#Raw(level, messages) abort
-  if a:level > g:ollama_debug
+  if a:level > ollama#logger#Level()
      return
   endif
 
@@ -129,6 +198,7 @@ function! ollama#logger#Raw(level, messages) abort
   try
     " write to file
     if filewritable(g:ollama_logfile)
+      call s:RotateFile()
       call writefile(l:lines, g:ollama_logfile, 'a')
       return
     endif
@@ -141,7 +211,7 @@ function! ollama#logger#Raw(level, messages) abort
 endfunction
 
 function! ollama#logger#Debug(...) abort
-  if empty(get(g:, 'ollama_debug'))
+  if ollama#logger#Level() < 4
     return
   endif
   call ollama#logger#Raw(4, a:000)
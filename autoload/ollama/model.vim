@@ -0,0 +1,344 @@
+" SPDX-License-Identifier: GPL-3.0-or-later
+" SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
+"
+" Switching models at runtime without editing the configuration.
+scriptencoding utf-8
+
+" Maps the model kinds to the global variables
+let s:model_vars = {
+    \ 'completion': ['g:ollama_model', 'g:ollama_model_provider'],
+    \ 'chat': ['g:ollama_chat_model', 'g:ollama_chat_provider'],
+    \ 'edit': ['g:ollama_edit_model', 'g:ollama_edit_provider'],
+    \ }
+
+" Returns 1 if there is a FIM config in g:ollama_fim_config_dir or
+" python/configs for the model. This uses the same name matching as
+" load_config() in complete.py.
+function! ollama#model#HasFimConfig(model) abort
+    " strip tag (e.g ':7b-code') and namespace
+    let l:name = substitute(a:model, ':[^:]*$', '', '')
+    let l:name = substitute(l:name, '^[^/]*/', '', '')
+    let l:config_dirs = [g:ollama_plugin_dir .. '/python/configs/']
+    if !empty(get(g:, 'ollama_fim_config_dir', ''))
+        call insert(l:config_dirs, expand(g:ollama_fim_config_dir) .. '/')
+    endif
+    let l:current = l:name
+    while 1
+        for l:config_dir in l:config_dirs
+            if filereadable(l:config_dir .. l:current .. '.json')
+                return 1
+            endif
+        endfor
+        " strip trailing part: first by '-', then strip trailing digits
+        if l:current =~ '-'
+            let l:next = substitute(l:current, '-[^-]*$', '', '')
+        else
+            let l:next = substitute(l:current, '[0-9.]\+$', '', '')
+        endif
+        if l:next ==# l:current
+            return 0
+        endif
+        let l:current = l:next
+    endwhile
+endfunction
+
+" Returns 1 if the model is in the list of installed models
+function! s:IsInstalled(models, model) abort
+    let l:model = a:model =~ ':' ? a:model : a:model .. ':latest'
+    return index(a:models, a:model) != -1 || index(a:models, l:model) != -1
+endfunction
+
+" Checks if the model is installed, and offers to pull it if not
+function! s:CheckInstalled(model) abort
+    let l:models = ollama#setup#GetModels(g:ollama_host)
+    if l:models == ['error']
+        echohl WarningMsg
+        echom "Could not check if '" .. a:model .. "' is installed."
+        echohl None
+        return
+    endif
+    if s:IsInstalled(l:models, a:model)
+        return
+    endif
+    let l:ans = confirm("The model '" .. a:model .. "' is not installed. Pull it now?", "&Yes\n&No", 1)
+    if l:ans == 1
+        call ollama#setup#PullModel(g:ollama_host, a:model)
+    endif
+endfunction
+
+" models which were offered to pull in this session
+let s:pull_offered = {}
+
+" Restarts the completion after the missing model was pulled
+function! s:RetryCompletion(exit_code) abort
+    if a:exit_code == 0 && mode() =~# '^i'
+        call ollama#TriggerCompletion()
+    endif
+endfunction
+
+" Called when a completion failed because the model is not installed.
+" Depending on g:ollama_pull_missing_model the model gets pulled and the
+" completion is retried afterwards. We only ask once per model.
+function! ollama#model#HandleMissingModel(model) abort
+    call ollama#logger#Error("Model '" .. a:model .. "' is not installed")
+    if g:ollama_pull_missing_model ==# 'never' || has_key(s:pull_offered, a:model)
+        echohl WarningMsg
+        echom "The model '" .. a:model .. "' is not installed. Use ':OllamaPull " .. a:model .. "' to install it."
+        echohl None
+        return
+    endif
+    let s:pull_offered[a:model] = 1
+    if g:ollama_pull_missing_model !=# 'always'
+        let l:ans = confirm("The model '" .. a:model .. "' is not installed. Pull it now?", "&Yes\n&No", 1)
+        if l:ans != 1
+            return
+        endif
+    endif
+    call ollama#setup#PullModel(g:ollama_host, a:model, function('s:RetryCompletion'))
+endfunction
+
+" models for which the missing FIM config was reported in this session
+let s:fim_reported = {}
+
+" Called when a completion failed because there is no FIM config for the
+" model. The message is only shown once per model, otherwise it would be
+" shown for every completion.
+function! ollama#model#HandleMissingFimConfig(model) abort
+    call ollama#logger#Error("No fill-in-the-middle config for '" .. a:model .. "'")
+    if has_key(s:fim_reported, a:model)
+        return
+    endif
+    let s:fim_reported[a:model] = 1
+    echohl WarningMsg
+    echom "No fill-in-the-middle config for '" .. a:model .. "'. "
+                \ .. "Add one to g:ollama_fim_config_dir, see python/configs/README.md."
+    echohl None
+endfunction
+
+" Returns the model kind used in the given buffer (default: current
+" buffer): 'chat' in chat buffers, otherwise 'completion'
+function! ollama#model#ContextKind(...) abort
+    let l:buf = a:0 > 0 ? a:1 : bufnr('')
+    return ollama#review#IsChatBuffer(l:buf) ? 'chat' : 'completion'
+endfunction
+
+" Returns the active model of the given kind
+function! ollama#model#Get(kind) abort
+    return eval(s:model_vars[a:kind][0])
+endfunction
+
+" running warm-up job
+let s:warmup_job = v:null
+
+function! s:WarmupExit(model, job, exit_code) abort
+    let s:warmup_job = v:null
+    if a:exit_code == 0
+        call ollama#logger#Info("Warm-up of '" .. a:model .. "' done")
+    else
+        call ollama#logger#Error("Warm-up of '" .. a:model .. "' failed with exit code " .. a:exit_code)
+    endif
+endfunction
+
+" Returns the keep alive arguments for the Python scripts. An empty
+" g:ollama_keep_alive uses the server default.
+function! ollama#model#KeepAliveArgs(option) abort
+    let l:keep_alive = get(g:, 'ollama_keep_alive', '')
+    if type(l:keep_alive) == v:t_string && empty(l:keep_alive)
+        return []
+    endif
+    return [a:option, '' .. l:keep_alive]
+endfunction
+
+" Loads the completion model in the background, so the first completion
+" doesn't need to wait for it. Does nothing for other providers than
+" Ollama.
+function! ollama#model#Warmup() abort
+    if g:ollama_model_provider !=# 'ollama' || empty(g:ollama_model)
+        return
+    endif
+    if s:warmup_job isnot v:null && job_status(s:warmup_job) ==# 'run'
+        call job_stop(s:warmup_job)
+    endif
+    let l:command = [ g:ollama_python_interpreter,
+                \ g:ollama_plugin_dir .. '/python/load_model.py',
+                \ '-u', g:ollama_host,
+                \ '-m', g:ollama_model ]
+                \ + ollama#model#KeepAliveArgs('-k') + ollama#connection#Args()
+    call ollama#logger#Debug("Warm-up command=" .. join(l:command, ' '))
+    let s:warmup_job = job_start(l:command, {
+                \ 'out_cb': {ch, msg -> ollama#logger#Debug('load_model: ' .. msg)},
+                \ 'err_cb': {ch, msg -> ollama#logger#Error('load_model: ' .. msg)},
+                \ 'exit_cb': function('s:WarmupExit', [g:ollama_model]),
+                \ })
+endfunction
+
+" Shows the active models, the one used in the current buffer is marked
+" with '%'
+function! s:ShowModels() abort
+    let l:context = ollama#model#ContextKind()
+    for l:kind in ['completion', 'chat', 'edit']
+        let [l:model_var, l:provider_var] = s:model_vars[l:kind]
+        let l:project = l:kind ==# 'completion' ? ollama#project#Get('model', '') : ''
+        echo printf('%s %-10s %s (%s)%s', l:kind ==# l:context ? '%' : ' ',
+                    \ l:kind .. ':', eval(l:model_var), eval(l:provider_var),
+                    \ empty(l:project) ? '' : ', project: ' .. l:project)
+    endfor
+endfunction
+
+" Implements :OllamaModel [kind] {name}. Sets the model for the given kind
+" (completion, chat or edit). The default kind depends on the current
+" buffer, see ollama#model#ContextKind(). The setting is used by all
+" following requests of this Vim session.
+function! ollama#model#Command(...) abort
+    if a:0 == 0
+        call s:ShowModels()
+        return
+    endif
+    if a:0 == 1
+        let l:kind = ollama#model#ContextKind()
+        let l:model = a:1
+    elseif a:0 == 2 && has_key(s:model_vars, a:1)
+        let l:kind = a:1
+        let l:model = a:2
+    else
+        echo "Usage: OllamaModel [completion|chat|edit] <name>"
+        return
+    endif
+    call ollama#model#SetModel(l:kind, l:model)
+endfunction
+
+" Sets the model of the given kind and validates it
+function! ollama#model#SetModel(kind, model) abort
+    let [l:model_var, l:provider_var] = s:model_vars[a:kind]
+    let l:provider = eval(l:provider_var)
+    execute 'let' l:model_var '= a:model'
+    call ollama#logger#Info("Switched " .. a:kind .. " model to " .. a:model)
+    echo "Using '" .. a:model .. "' as " .. a:kind .. " model."
+                \ .. (a:kind ==# 'chat' ? " Running chats keep their model." : '')
+    let l:project = a:kind ==# 'completion' ? ollama#project#Get('model', '') : ''
+    if !empty(l:project) && l:project !=# a:model
+        echohl WarningMsg
+        echom "The project config of this buffer overrides it with '" .. l:project .. "'."
+        echohl None
+    endif
+
+    if l:provider !=# 'ollama'
+        return
+    endif
+    if a:kind ==# 'completion' && g:ollama_warmup
+        call ollama#model#Warmup()
+    endif
+    if a:kind ==# 'completion' && !ollama#model#HasFimConfig(a:model)
+        echohl WarningMsg
+        if g:ollama_fim_fallback
+            echom "No fill-in-the-middle config found for '" .. a:model .. "'. Using Ollama's template instead."
+        else
+            echom "No fill-in-the-middle config found for '" .. a:model .. "'. Completions will fail."
+        endif
+        echohl None
+    endif
+    call s:CheckInstalled(a:model)
+endfunction
+
+" Command line completion for :OllamaModel
+function! ollama#model#Complete(arglead, cmdline, cursorpos) abort
+    let l:args = split(strpart(a:cmdline, 0, a:cursorpos))
+    " number of complete arguments before the one being typed
+    let l:count = len(l:args) - 1 - (empty(a:arglead) ? 0 : 1)
+    let l:candidates = []
+    if l:count == 0
+        let l:candidates += keys(s:model_vars)
+    endif
+    if l:count <= 1
+        let l:models = ollama#setup#GetModels(g:ollama_host)
+        if l:models != ['error']
+            let l:candidates += l:models
+        endif
+    endif
+    return filter(sort(l:candidates), {_, c -> stridx(c, a:arglead) == 0})
+endfunction
+
+" Command line completion for :OllamaModels
+function! ollama#model#CompleteKind(arglead, cmdline, cursorpos) abort
+    return filter(sort(keys(s:model_vars)), {_, c -> stridx(c, a:arglead) == 0})
+endfunction
+
+" Returns the installed Ollama models as list of dicts with the keys 'name',
+" 'size', 'family' and 'params'. Returns v:null on error.
+function! s:GetModelDetails() abort
+    let l:script_path = printf('%s/python/list_models.py', g:ollama_plugin_dir)
+    let l:command = join([ g:ollama_python_interpreter, shellescape(l:script_path),
+                \ '-u', shellescape(g:ollama_host), '-v' ]
+                \ + map(ollama#connection#Args(), {_, a -> shellescape(a)}) + [ '2>&1' ], ' ')
+    let l:output = system(l:command)
+    if v:shell_error != 0
+        echohl ErrorMsg
+        echom "Failed to fetch models from " .. g:ollama_host .. ". Is Ollama running?"
+        echohl None
+        call ollama#logger#Error("list_models.py failed: " .. l:output)
+        return v:null
+    endif
+    let l:models = []
+    for l:line in split(l:output, "\n")
+        let l:fields = split(l:line, "\t", 1)
+        if len(l:fields) >= 4
+            call add(l:models, {'name': l:fields[0], 'size': l:fields[1],
+                        \ 'family': l:fields[2], 'params': l:fields[3]})
+        endif
+    endfor
+    return l:models
+endfunction
+
+" Formats a model for the picker
+function! s:FormatModel(model) abort
+    return printf('%-40s %10s  %-12s %s', a:model.name, a:model.size, a:model.family, a:model.params)
+endfunction
+
+function! s:PickerCallback(kind, models, id, result) abort
+    if a:result > 0
+        call ollama#model#SetModel(a:kind, a:models[a:result - 1].name)
+    endif
+endfunction
+
+function! s:FzfSink(kind, line) abort
+    call ollama#model#SetModel(a:kind, split(a:line)[0])
+endfunction
+
+" Implements :OllamaModels [kind]. Shows the installed models and sets the
+" chosen one as active model of the given kind (default: depends on the
+" current buffer).
+function! ollama#model#Picker(...) abort
+    let l:kind = a:0 > 0 ? a:1 : ollama#model#ContextKind()
+    if !has_key(s:model_vars, l:kind)
+        echo "Usage: OllamaModels [completion|chat|edit]"
+        return
+    endif
+    let l:models = s:GetModelDetails()
+    if l:models is v:null
+        return
+    endif
+    if empty(l:models)
+        echo "No models installed. Use :OllamaPull to install one."
+        return
+    endif
+    let l:lines = map(copy(l:models), {_, m -> s:FormatModel(m)})
+    if exists('*fzf#run') && exists('*fzf#wrap')
+        call fzf#run(fzf#wrap({
+                    \ 'source': l:lines,
+                    \ 'sink': function('s:FzfSink', [l:kind]),
+                    \ 'options': ['--prompt', 'Ollama ' .. l:kind .. ' model> '],
+                    \ }))
+        return
+    endif
+    let l:current = eval(s:model_vars[l:kind][0])
+    let l:id = popup_menu(l:lines, {
+                \ 'title': ' Select ' .. l:kind .. ' model ',
+                \ 'callback': function('s:PickerCallback', [l:kind, l:models]),
+                \ 'padding': [0, 1, 0, 1],
+                \ })
+    " select the active model
+    let l:idx = index(map(copy(l:models), {_, m -> m.name}), l:current)
+    if l:idx > 0
+        call win_execute(l:id, 'normal! ' .. (l:idx + 1) .. 'G')
+    endif
+endfunction
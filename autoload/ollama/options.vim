@@ -0,0 +1,84 @@
+" SPDX-License-Identifier: GPL-3.0-or-later
+" SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
+"
+" Parses generation options given inline to commands, e.g.
+" ':OllamaChat temperature=0.2'. These override the defaults in
+" g:ollama_chat_options or g:ollama_model_options for one invocation.
+scriptencoding utf-8
+
+" Supported options: [type, min, max]. v:null means unlimited.
+let s:option_ranges = {
+    \ 'temperature': ['float', 0, 2],
+    \ 'top_p': ['float', 0, 1],
+    \ 'min_p': ['float', 0, 1],
+    \ 'top_k': ['int', 0, v:null],
+    \ 'num_predict': ['int', -2, v:null],
+    \ 'num_ctx': ['int', 1, v:null],
+    \ 'max_tokens': ['int', 1, v:null],
+    \ 'repeat_penalty': ['float', 0, v:null],
+    \ 'repeat_last_n': ['int', -1, v:null],
+    \ 'seed': ['int', v:null, v:null],
+    \ }
+
+function! s:Error(msg) abort
+    echohl ErrorMsg
+    echom a:msg
+    echohl None
+endfunction
+
+" Converts the value to a number and validates the range.
+" Returns v:null on error.
+function! s:ParseValue(key, value) abort
+    let [l:type, l:min, l:max] = s:option_ranges[a:key]
+    if l:type ==# 'int'
+        if a:value !~# '^-\?\d\+$'
+            call s:Error("Option '" .. a:key .. "' must be an integer: " .. a:value)
+            return v:null
+        endif
+        let l:number = str2nr(a:value)
+    else
+        if a:value !~# '^-\?\(\d\+\.\?\d*\|\.\d\+\)$'
+            call s:Error("Option '" .. a:key .. "' must be a number: " .. a:value)
+            return v:null
+        endif
+        let l:number = str2float(a:value =~# '^-\?\.' ? substitute(a:value, '\.', '0.', '') : a:value)
+    endif
+    if (l:min isnot v:null && l:number < l:min) || (l:max isnot v:null && l:number > l:max)
+        let l:range = (l:min is v:null ? '' : l:min) .. '..' .. (l:max is v:null ? '' : l:max)
+        call s:Error("Option '" .. a:key .. "' is out of range " .. l:range .. ": " .. a:value)
+        return v:null
+    endif
+    return l:number
+endfunction
+
+" Splits the command arguments into plain arguments and key=value options.
+" Returns [args, options], or v:null if an option is unknown or invalid.
+function! ollama#options#Parse(args) abort
+    let l:args = []
+    let l:options = {}
+    for l:arg in a:args
+        let l:match = matchlist(l:arg, '^\([a-z_]\+\)=\(.*\)$')
+        if empty(l:match)
+            call add(l:args, l:arg)
+            continue
+        endif
+        let [l:key, l:value] = l:match[1:2]
+        if !has_key(s:option_ranges, l:key)
+            call s:Error("Unknown option '" .. l:key .. "'. Supported options: "
+                        \ .. join(sort(keys(s:option_ranges)), ', '))
+            return v:null
+        endif
+        let l:number = s:ParseValue(l:key, l:value)
+        if l:number is v:null
+            return v:null
+        endif
+        let l:options[l:key] = l:number
+    endfor
+    return [l:args, l:options]
+endfunction
+
+" Command line completion for the option names
+function! ollama#options#Complete(arglead, cmdline, cursorpos) abort
+    let l:candidates = map(sort(keys(s:option_ranges)), {_, k -> k .. '='})
+    return filter(l:candidates, {_, c -> stridx(c, a:arglead) == 0})
+endfunction
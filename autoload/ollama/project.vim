@@ -0,0 +1,151 @@
+" SPDX-License-Identifier: GPL-3.0-or-later
+" SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
+"
+" Project configuration: a JSON file (g:ollama_project_config) in the
+" project root which can disable the plugin, exclude files and override
+" the completion model and context settings for all buffers below it.
+" The file is found by walking up from the buffer's directory.
+scriptencoding utf-8
+
+" supported keys and their types
+let s:keys = {
+    \ 'enabled': v:t_bool,
+    \ 'model': v:t_string,
+    \ 'model_options': v:t_dict,
+    \ 'context_files': v:t_number,
+    \ 'context_budget': v:t_number,
+    \ 'ignore': v:t_list,
+    \ }
+
+" parsed config files: maps the file name to {'ftime': ..., 'config': ...}
+let s:cache = {}
+
+function! s:Warn(msg) abort
+    call ollama#logger#Error(a:msg)
+    echohl WarningMsg
+    echom a:msg
+    echohl None
+endfunction
+
+" Reads and validates the config file. Invalid entries are dropped.
+function! s:Load(file) abort
+    try
+        let l:config = json_decode(join(readfile(a:file), "\n"))
+    catch
+        call s:Warn("Invalid JSON in " .. a:file .. ": " .. v:exception)
+        return {}
+    endtry
+    if type(l:config) != v:t_dict
+        call s:Warn("Invalid project config " .. a:file .. ": expected a JSON object")
+        return {}
+    endif
+    for [l:key, l:value] in items(l:config)
+        if !has_key(s:keys, l:key)
+            call s:Warn("Unknown key '" .. l:key .. "' in " .. a:file)
+            call remove(l:config, l:key)
+        elseif type(l:value) != s:keys[l:key]
+            call s:Warn("Invalid type of '" .. l:key .. "' in " .. a:file)
+            call remove(l:config, l:key)
+        endif
+    endfor
+    let l:config.root = fnamemodify(a:file, ':p:h')
+    return l:config
+endfunction
+
+" Returns the config file of the buffer, or '' if there is none
+function! s:FindFile(buf) abort
+    let l:found = getbufvar(a:buf, 'ollama_project_file', v:null)
+    " a deleted config file is searched again, a new one is found after
+    " it was written in Vim (see ollama#project#FileWritten())
+    if l:found isnot v:null && (empty(l:found) || filereadable(l:found))
+        return l:found
+    endif
+    let l:found = ''
+    let l:name = bufname(a:buf)
+    if !empty(get(g:, 'ollama_project_config', '')) && getbufvar(a:buf, '&buftype') ==# '' && !empty(l:name)
+        let l:found = findfile(g:ollama_project_config, fnamemodify(l:name, ':p:h') .. ';')
+        let l:found = empty(l:found) ? '' : fnamemodify(l:found, ':p')
+    endif
+    " the lookup is done once per buffer, it runs on every keystroke
+    call setbufvar(a:buf, 'ollama_project_file', l:found)
+    return l:found
+endfunction
+
+" Called after a file was written: a new or renamed config file can
+" change the config file of any buffer, so all buffers search again.
+function! ollama#project#FileWritten(file) abort
+    if empty(get(g:, 'ollama_project_config', '')) || fnamemodify(a:file, ':t') !=# g:ollama_project_config
+        return
+    endif
+    for l:info in getbufinfo()
+        if has_key(l:info.variables, 'ollama_project_file')
+            call remove(l:info.variables, 'ollama_project_file')
+        endif
+    endfor
+endfunction
+
+" Returns the project config of the buffer (default: current buffer) as
+" dict, empty if there is no config file. The key 'root' is the project
+" directory. Changed files are reloaded.
+function! ollama#project#Config(...) abort
+    let l:file = s:FindFile(a:0 > 0 ? a:1 : bufnr(''))
+    if empty(l:file)
+        return {}
+    endif
+    let l:ftime = getftime(l:file)
+    let l:entry = get(s:cache, l:file, {})
+    if get(l:entry, 'ftime', -2) != l:ftime
+        call ollama#logger#Info("Loading project config " .. l:file)
+        let l:entry = {'ftime': l:ftime, 'config': l:ftime == -1 ? {} : s:Load(l:file)}
+        let s:cache[l:file] = l:entry
+    endif
+    return l:entry.config
+endfunction
+
+" Returns the value of the key in the project config, or the default
+function! ollama#project#Get(key, default) abort
+    return get(ollama#project#Config(), a:key, a:default)
+endfunction
+
+" Returns 1 if the file matches one of the 'ignore' patterns. Like in
+" .gitignore, patterns without '/' match the file name or any directory
+" name, patterns with '/' match the path relative to the project root,
+" and a pattern ending with '/' matches a directory.
+function! ollama#project#IsIgnored(file, ...) abort
+    let l:config = a:0 > 0 ? a:1 : ollama#project#Config()
+    let l:patterns = get(l:config, 'ignore', [])
+    if empty(l:patterns)
+        return 0
+    endif
+    let l:path = fnamemodify(a:file, ':p')
+    let l:root = l:config.root .. '/'
+    if stridx(l:path, l:root) != 0
+        " not in this project
+        return 0
+    endif
+    let l:rel = strpart(l:path, len(l:root))
+    let l:parts = split(l:rel, '/')
+    for l:pattern in l:patterns
+        if type(l:pattern) != v:t_string || empty(l:pattern)
+            continue
+        endif
+        if l:pattern =~# '/$'
+            " directory: match any leading part of the path
+            let l:dir = substitute(l:pattern, '^/\|/$', '', 'g')
+            let l:candidates = map(range(len(l:parts) - 1), {i -> l:dir =~# '/' ? join(l:parts[: i], '/') : l:parts[i]})
+        elseif l:pattern =~# '/'
+            let l:dir = substitute(l:pattern, '^/', '', '')
+            let l:candidates = [l:rel]
+        else
+            let l:dir = l:pattern
+            let l:candidates = l:parts
+        endif
+        let l:regex = glob2regpat(l:dir)
+        for l:candidate in l:candidates
+            if l:candidate =~# l:regex
+                return 1
+            endif
+        endfor
+    endfor
+    return 0
+endfunction
@@ -1,47 +1,186 @@
 " SPDX-License-Identifier: GPL-3.0-or-later
 " SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
-let s:job = v:null
-let s:buf = -1
 let s:ollama_bufname = 'Ollama Chat'
+" Active chat sessions by buffer number. Each session has its own chat
+" process, streaming state, source buffer and attachment.
+let s:sessions = {}
+" buffer of the last used chat session
+let s:last_buf = -1
+let s:flush_interval = 50
+" interval and timeout in ms for waiting until a stopped chat process is
+" gone, before it gets killed
+let s:stop_interval = 50
+let s:stop_timeout = 1000
+" printed by chat.py in front of error messages
+let s:error_marker = '<ERROR>'
+" 1 if the next chat should restore the last conversation
+let s:restore = 0
+" options given to :OllamaChat which override g:ollama_chat_options for the
+" next chat
+let s:chat_options = {}
 
 if !exists('g:ollama_review_logfile')
     let g:ollama_review_logfile = tempname() .. '-ollama-review.log'
 endif
 
+" Returns the buffer name of the chat session with the given name
+function! s:SessionBufName(name) abort
+    return empty(a:name) ? s:ollama_bufname : s:ollama_bufname .. ': ' .. a:name
+endfunction
+
+" Creates the state of a new chat session
+function! s:NewSession(name) abort
+    return {
+        \ 'name': a:name,
+        \ 'buf': -1,
+        \ 'job': v:null,
+        \ 'terminal': 0,
+        \ 'pending': '',
+        \ 'flush_timer': -1,
+        \ 'error': '',
+        \ 'line_complete': 1,
+        \ 'source': {'buf': -1, 'first': 0, 'last': 0, 'lines': []},
+        \ 'attachment': [],
+        \ }
+endfunction
+
+" Returns the session with the given name or v:null
+function! s:FindSession(name) abort
+    for l:session in values(s:sessions)
+        if l:session.name ==# a:name
+            return l:session
+        endif
+    endfor
+    return v:null
+endfunction
+
+" Returns the session of the current buffer, or the last used session if
+" the current buffer is no chat. Returns v:null if there is no session.
+function! s:CurrentSession() abort
+    return get(s:sessions, bufnr(''), get(s:sessions, s:last_buf, v:null))
+endfunction
+
+" Returns 1 if the buffer is a chat buffer
+function! ollama#review#IsChatBuffer(buf) abort
+    return has_key(s:sessions, a:buf)
+endfunction
+
+" Returns 1 if the chat process of the buffer is running
+function! ollama#review#IsRunning(buf) abort
+    let l:job = get(get(s:sessions, a:buf, {}), 'job', v:null)
+    return type(l:job) == v:t_job && job_status(l:job) ==# 'run'
+endfunction
+
+" Timer callback which waits until the chat process is gone. A process
+" which ignores the termination request gets killed after s:stop_timeout.
+func! s:PollStop(state, timer)
+    if job_status(a:state.job) != 'run'
+        call timer_stop(a:timer)
+        call a:state.Callback(1)
+        return
+    endif
+    let a:state.waited += s:stop_interval
+    if a:state.waited < s:stop_timeout
+        return
+    endif
+    if a:state.killed
+        call timer_stop(a:timer)
+        call a:state.Callback(0)
+        return
+    endif
+    call ollama#logger#Debug("Chat process did not terminate, killing it")
+    call job_stop(a:state.job, "kill")
+    let a:state.killed = 1
+    let a:state.waited = 0
+endfunc
+
+" Terminates the chat process of the session without blocking Vim. The
+" optional callback gets 1 when the process is gone, or 0 if it could not
+" be killed.
+func! s:StopSessionJob(session, ...)
+    let l:Callback = a:0 > 0 ? a:1 : {_ -> 0}
+    let l:job = a:session.job
+    if type(l:job) != v:t_job || job_status(l:job) != 'run'
+        call l:Callback(1)
+        return
+    endif
+    if !a:session.terminal && ch_status(l:job, {'part': 'in'}) == 'open'
+        " chat.py exits by itself if it is waiting for input
+        call ch_sendraw(l:job, "quit\n")
+    endif
+    " Terminating the process also closes the HTTP stream, which makes
+    " Ollama abort the generation on the server side. This works no matter
+    " if the model is streaming tokens or still processing the prompt.
+    call job_stop(l:job)
+    let l:state = {'job': l:job, 'Callback': l:Callback, 'waited': 0, 'killed': 0}
+    call timer_start(s:stop_interval, function('s:PollStop', [l:state]), {'repeat': -1})
+endfunc
+
+" Frees all resources of the session
+func! s:CloseSession(session)
+    call remove(s:sessions, a:session.buf)
+    call ollama#throttle#Cancel('chat:' .. a:session.buf)
+    call ollama#status#End('chat:' .. a:session.buf)
+    if a:session.flush_timer != -1
+        call timer_stop(a:session.flush_timer)
+        let a:session.flush_timer = -1
+    endif
+    if s:last_buf == a:session.buf
+        let s:last_buf = -1
+    endif
+    call s:StopSessionJob(a:session)
+endfunc
+
+" Terminates the chat process of the focused chat session
 func! ollama#review#KillChatBot()
     call ollama#logger#Debug("KillChatBot")
+    let l:session = get(s:sessions, bufnr(''), v:null)
+    if l:session is v:null
+        echo "Not in a chat buffer."
+        return
+    endif
 
     " Stop the job if it exists
-    if exists("s:job") && type(s:job) == v:t_job
-        call ch_sendraw(s:job, "quit\n")
-        call job_stop(s:job)
-        while job_status(s:job) == 'run'
-            sleep 1
-        endwhile
-        let s:buf = -1
+    if type(l:session.job) == v:t_job && job_status(l:session.job) == 'run'
+        call s:StopSessionJob(l:session, function('s:ReportStopped'))
     else
         call ollama#logger#Debug("No job to kill")
     endif
 endfunc
 
+func! s:ReportStopped(success)
+    if a:success
+        call ollama#logger#Debug("Chat process terminated")
+        echo "Chat process terminated."
+    else
+        call ollama#logger#Error("Failed to terminate chat process")
+        echohl ErrorMsg
+        echom "Failed to terminate the chat process."
+        echohl None
+    endif
+endfunc
+
 func! s:BufReallyDelete(buf)
     call ollama#logger#Debug("BufReallyDelete " .. a:buf)
-    execute "bwipeout! " .. a:buf
+    if bufexists(a:buf)
+        execute "bwipeout! " .. a:buf
+    endif
 endfunc
 
 func! ollama#review#BufDelete(buf)
     call ollama#logger#Debug("BufDelete")
-    if a:buf == s:buf
-        call ollama#logger#Debug("Deleting buffer " .. a:buf)
+    let l:buf = str2nr(a:buf)
+    if has_key(s:sessions, l:buf)
+        call ollama#logger#Debug("Deleting buffer " .. l:buf)
         " The buffer was closed by :quit or :q!
-        call ollama#review#KillChatBot()
+        call s:CloseSession(s:sessions[l:buf])
         " Undo 'buftype=prompt' and make buffer deletable
-        if bufexists(s:buf)
-            setlocal buftype=
-            setlocal modifiable
+        if bufexists(l:buf) && getbufvar(l:buf, '&buftype') == 'prompt'
+            call setbufvar(l:buf, '&buftype', '')
+            call setbufvar(l:buf, '&modifiable', 1)
         endif
         " We cannot wipe the buffer while being used in autocmd
-        call timer_start(10, {-> s:BufReallyDelete(a:buf)})
+        call timer_start(10, {-> s:BufReallyDelete(l:buf)})
     endif
 endfunc
 
@@ -55,92 +194,67 @@ function! s:FindBufferWindow(bufnr)
     return -1
 endfunction
 
-function! s:StartChat(lines) abort
-    " Function handling a line of text that has been typed.
-    func! TextEntered(text)
-        call ollama#logger#Debug("TextEntered: " .. a:text)
-        if a:text == ''
-            " don't send empty messages
-            return
-        endif
-        " Send the text to a shell with Enter appended.
-        call ch_sendraw(s:job, a:text .. "\n")
-    endfunc
-
-    " Function handling output from the shell: Add it above the prompt.
-    func! GotOutput(channel, msg)
-        call ollama#logger#Debug("GotOutput: " .. a:msg)
-
-        " append lines
-        let l:lines = split(a:msg, "\n")
-        for l:line in l:lines
-            " when we received <EOT> start insert mode again
-            let l:idx = stridx(l:line, "<EOT>")
-            if l:idx != -1
-                call ollama#logger#Debug("idx=" .. l:idx)
-                let l:line = strpart(l:line, 0, l:idx)
-            endif
-            call appendbufline(s:buf, "$", l:line)
-            if bufname() == s:ollama_bufname " Check if current active window is Ollama Chat
-                " check if in insert mode
-                if mode() == 'i'
-                    " start insert mode again
-                    call feedkeys("\<Esc>")
-                endif
-                call feedkeys("G") "jump to end
-                if l:idx != -1
-                    " start insert mode
-                    call feedkeys("a")
-                endif
-            endif
-        endfor
-    endfunc
+" Returns the command modifier for splitting windows as configured
+function! s:SplitCommand() abort
+    return get(g:, 'ollama_split_vertically', 0) == 1 ? 'vertical ' : ''
+endfunction
 
-    " Function handling output from the shell: Add it above the prompt.
-    func! GotErrors(channel, msg)
-        call ollama#logger#Debug("GotErrors: " .. a:msg)
+" Moves the cursor to the window of the session or opens a new one.
+" Switching the buffer of the current window is avoided, because this would
+" delete a chat running in this window.
+function! s:ShowSession(session) abort
+    let l:chat_win = s:FindBufferWindow(a:session.buf)
+    if l:chat_win != -1
+        execute l:chat_win .. 'wincmd w'
+    else
+        execute s:SplitCommand() .. 'sbuffer' a:session.buf
+    endif
+    let s:last_buf = a:session.buf
+endfunction
 
-        let l:bufname = 'stderr'
-        let l:bufnr = bufnr(l:bufname)
-        if (l:bufnr != -1)
-            " buffer already exists
-            silent execute 'buffer' l:bufnr
-        else
-            " create new error buffer
-            silent execute 'new' l:bufname
+" Returns the system prompt for new chats and where it comes from as list.
+" A project file (g:ollama_chat_systemprompt_file) in the working directory
+" or one of its parents overrides g:ollama_chat_systemprompt.
+function! s:SystemPrompt() abort
+    if !empty(g:ollama_chat_systemprompt_file)
+        let l:file = findfile(g:ollama_chat_systemprompt_file, escape(getcwd(), ' ,;') .. ';')
+        if !empty(l:file)
+            return [trim(join(readfile(l:file), "\n")), fnamemodify(l:file, ':p')]
         endif
+    endif
+    return [g:ollama_chat_systemprompt, 'g:ollama_chat_systemprompt']
+endfunction
 
-        setlocal buftype=nofile
-        setlocal bufhidden=delete
-
-        call append(line("$"), a:msg)
-        stopinsert
-    endfunc
-
-    " Function handling the shell exits: close the window.
-    func! JobExit(job, status)
-        call ollama#logger#Debug("JobExit: " .. a:status)
-        " Switch to the chat buffer
-        execute 'buffer' s:buf
-        " Turn off prompt functionality and make the buffer modifiable
-        call prompt_setprompt(s:buf, '')
-        setlocal buftype=
-        setlocal modifiable
-        " output info message
-        call append(line("$") - 1, "Chat process terminated with exit code " .. a:status)
-        call append(line("$") - 1, "Use ':q' or ':bd' to delete this buffer and run ':OllamaChat' again to create a new session.")
-        stopinsert
-        let s:buf = -1
-        " avoid saving and make :q just work
-        setlocal nomodified
-    endfunc
+" Implements :OllamaSystemPrompt[!] [text]. Without arguments the current
+" system prompt is shown, the bang clears it.
+function! ollama#review#SystemPrompt(bang, text) abort
+    if a:bang
+        let g:ollama_chat_systemprompt = ''
+    elseif a:text != ''
+        let g:ollama_chat_systemprompt = a:text
+    endif
+    let [l:prompt, l:source] = s:SystemPrompt()
+    if l:prompt == ''
+        echo "No system prompt, the model's default is used."
+    else
+        echo "System prompt (" .. l:source .. "):\n" .. l:prompt
+    endif
+    if (a:bang || a:text != '') && l:source !=# 'g:ollama_chat_systemprompt'
+        echohl WarningMsg
+        echo "The project file overrides g:ollama_chat_systemprompt."
+        echohl None
+    endif
+endfunction
 
-    let l:model_options = json_encode(g:ollama_chat_options)
-    call ollama#logger#Debug("Connecting to Ollama on " .. g:ollama_host .. " using model " .. g:ollama_model)
+" Returns the command line for starting the chat script of the session with
+" the given name
+function! s:ChatCommand(name) abort
+    let l:model_options = json_encode(extend(copy(g:ollama_chat_options), s:chat_options))
+    call ollama#logger#Debug("Connecting to Ollama on " .. g:ollama_host .. " using model " .. g:ollama_chat_model)
     call ollama#logger#Debug("model_options=" .. l:model_options)
 
     " Convert plugin debug level to python logger levels
-    let l:log_level = ollama#logger#PythonLogLevel(g:ollama_debug)
+    let l:log_level = ollama#logger#PythonLogLevel(ollama#logger#Level())
     let l:base_url = g:ollama_host
     if g:ollama_chat_provider == 'openai'
         let l:base_url = g:ollama_openai_baseurl
@@ -155,57 +269,369 @@ function! s:StartChat(lines) abort
                 \ '-u', l:base_url,
                 \ '-o', l:model_options,
                 \ '-t', g:ollama_chat_timeout,
-                \ '-l', l:log_level ]
+                \ '-l', l:log_level,
+                \ '--reasoning', g:ollama_chat_reasoning,
+                \ '--reasoning-delimiters', json_encode(g:ollama_reasoning_delimiters) ] + ollama#connection#Args()
     " Check if a system prompt was configured
-    if g:ollama_chat_systemprompt != ''
+    let l:systemprompt = s:SystemPrompt()[0]
+    if l:systemprompt != ''
          " add system prompt option
-        let l:command += [ '-s', g:ollama_chat_systemprompt ]
+        let l:command += [ '-s', l:systemprompt ]
     endif
     " Add optional credentialname for looking up the API key
     if g:ollama_openai_credentialname != ''
          " add system prompt option
         let l:command += [ '-k', g:ollama_openai_credentialname ]
     endif
+    if g:ollama_chat_stats
+        let l:command += [ '-S' ]
+    endif
+    if g:ollama_chat_history
+        let l:command += [ '-H', s:HistoryFile(a:name) ]
+        if s:restore
+            let l:command += [ '-r' ]
+        endif
+    endif
+    let s:restore = 0
+    let s:chat_options = {}
+    return l:command
+endfunction
 
-    " Redirect job's IO to buffer
-    let job_options = {
-        \ 'out_cb': function('GotOutput'),
-        \ 'err_cb': function('GotErrors'),
-        \ 'exit_cb': function('JobExit'),
-        \ }
+" Returns the chat history file of the session with the given name in the
+" current project. The file name is derived from the working directory and
+" the session name, the default session uses only the directory.
+function! s:HistoryFile(name) abort
+    let l:key = empty(a:name) ? getcwd() : getcwd() .. "\n" .. a:name
+    return g:ollama_chat_history_dir .. '/' .. sha256(l:key) .. '.json'
+endfunction
 
-    " Start a shell in the background.
-    let s:job = job_start(l:command, l:job_options)
+" Starts a chat which continues the last conversation of this project.
+function! ollama#review#Restore(...) abort
+    let l:parsed = ollama#options#Parse(a:000)
+    if l:parsed is v:null
+        return
+    endif
+    let [l:args, l:options] = l:parsed
+    let l:name = len(l:args) > 0 ? l:args[0] : ''
+    if !g:ollama_chat_history
+        echoerr "The chat history is disabled (see g:ollama_chat_history)"
+        return
+    endif
+    if s:FindSession(l:name) isnot v:null
+        echoerr "The chat is already running, close it first using ':bd'"
+        return
+    endif
+    if !filereadable(s:HistoryFile(l:name))
+        echo "No chat history found for " .. (empty(l:name) ? '' : "'" .. l:name .. "' in ") .. getcwd()
+        return
+    endif
+    let s:restore = 1
+    let s:chat_options = l:options
+    call s:StartChat(v:null, l:name, s:ChatSource())
+endfunction
 
-    " Create chat buffer
-    let l:bufname = s:ollama_bufname
-    if (s:buf != -1)
-        " buffer already exists
-        let l:chat_win = s:FindBufferWindow(s:buf)
-        " switch to existing buffer
-        if l:chat_win != -1
-            execute l:chat_win  ..  'wincmd w'
-        else
-            execute 'buffer' s:buf
+" Sends lines of text to the terminal chat
+function! s:SendToTerminal(session, lines) abort
+    for l:line in a:lines
+        call term_sendkeys(a:session.buf, l:line .. "\r")
+    endfor
+endfunction
+
+" Returns the length of an incomplete UTF-8 sequence at the end of the
+" text, which must not be added to the buffer yet.
+function! s:IncompleteUtf8Len(text) abort
+    let l:len = len(a:text)
+    let l:i = 1
+    while l:i <= min([4, l:len])
+        let l:byte = char2nr(a:text[l:len - l:i])
+        if l:byte < 0x80
+            " ASCII character
+            return 0
+        elseif l:byte >= 0xC0
+            " lead byte: check if all continuation bytes have been received
+            let l:needed = l:byte >= 0xF0 ? 4 : l:byte >= 0xE0 ? 3 : 2
+            return l:needed > l:i ? l:i : 0
         endif
-        " send lines
-        if a:lines isnot v:null
-            call append(line("$") - 1, a:lines)
-            let l:prompt = join(a:lines, "\n")
-            call ollama#logger#Debug("Sending prompt '" .. l:prompt .. "'...")
-            call ch_sendraw(s:job, l:prompt .. "\n")
+        let l:i += 1
+    endwhile
+    return 0
+endfunction
+
+" Appends streamed text to the chat buffer. The text continues the last line
+" of the current response.
+function! s:AppendText(session, text) abort
+    let l:buf = a:session.buf
+    let l:lines = split(a:text, "\n", 1)
+    if a:session.line_complete
+        call appendbufline(l:buf, '$', l:lines[0])
+    else
+        let l:last = get(getbufline(l:buf, '$'), 0, '')
+        call setbufline(l:buf, '$', l:last .. l:lines[0])
+    endif
+    call appendbufline(l:buf, '$', l:lines[1:])
+    let a:session.line_complete = 0
+endfunction
+
+" Timer callback which adds the collected output to the chat buffer
+function! s:FlushOutput(buf, timer) abort
+    let l:session = get(s:sessions, a:buf, v:null)
+    if l:session is v:null
+        return
+    endif
+    let l:session.flush_timer = -1
+    if l:session.pending == '' || !bufexists(a:buf)
+        return
+    endif
+    " keep incomplete multibyte characters for the next flush
+    let l:keep = s:IncompleteUtf8Len(l:session.pending)
+    let l:text = strpart(l:session.pending, 0, len(l:session.pending) - l:keep)
+    let l:session.pending = strpart(l:session.pending, len(l:session.pending) - l:keep)
+
+    " when we received <EOT> the response is complete
+    let l:idx = stridx(l:text, "<EOT>")
+    if l:idx != -1
+        let l:text = strpart(l:text, 0, l:idx)
+    endif
+    " chat.py marks errors, the message is shown without the marker
+    let l:eidx = stridx(l:text, s:error_marker)
+    if l:eidx != -1
+        let l:text = strpart(l:text, 0, l:eidx) .. strpart(l:text, l:eidx + len(s:error_marker))
+        let l:session.error = trim(matchstr(l:text, '^[^\n]*', l:eidx))
+    endif
+
+    " remember which windows are showing the end of the chat
+    let l:last_line = line('$', bufwinid(a:buf))
+    let l:follow = filter(win_findbuf(a:buf), {_, id -> line('.', id) >= l:last_line})
+
+    if l:text != ''
+        call s:AppendText(l:session, l:text)
+    endif
+    if l:idx != -1
+        let l:session.line_complete = 1
+        let l:session.pending = ''
+        call ollama#status#End('chat:' .. a:buf, l:session.error)
+        let l:session.error = ''
+        call s:UpdateChatSyntax(a:buf)
+    endif
+
+    " auto-scroll only if the user did not move the cursor away from the end
+    for l:winid in l:follow
+        if l:winid == win_getid()
+            " check if in insert mode
+            if mode() == 'i'
+                call feedkeys("\<Esc>")
+            endif
+            call feedkeys("G") "jump to end
+        else
+            call win_execute(l:winid, 'normal! G')
         endif
+    endfor
+    if l:idx != -1 && bufnr('') == a:buf
+        " start insert mode again
+        call feedkeys("Ga")
+    endif
+endfunction
+
+" Function handling a line of text that has been typed.
+function! s:TextEntered(buf, text) abort
+    call ollama#logger#Debug("TextEntered: " .. a:text)
+    let l:session = get(s:sessions, a:buf, v:null)
+    if a:text == '' || l:session is v:null
+        " don't send empty messages
         return
     endif
+    let s:last_buf = a:buf
+    let l:text = a:text
+    if !empty(l:session.attachment)
+        " send the attached code together with the question
+        let l:text = join(['"""'] + l:session.attachment + [a:text, '"""'], "\n")
+        let l:session.attachment = []
+    endif
+    call ollama#throttle#Run('chat:' .. a:buf, function('s:SendPrompt', [a:buf, l:text]))
+endfunction
 
-    " Create new chat buffer
-    if exists('g:ollama_split_vertically') && g:ollama_split_vertically == 1
-        silent execute 'vnew' l:bufname
+" Sends the text to the chat process with Enter appended. The message may
+" have been queued by ollama#throttle#Run(), so the chat can be gone.
+function! s:SendPrompt(buf, text) abort
+    let l:session = get(s:sessions, a:buf, v:null)
+    if l:session is v:null
+        return
+    endif
+    call ch_sendraw(l:session.job, a:text .. "\n")
+    call ollama#status#Begin('chat:' .. a:buf)
+endfunction
+
+" Function handling output from the shell: Collect the streamed text,
+" it gets added to the buffer by a timer.
+function! s:GotOutput(buf, channel, msg) abort
+    call ollama#logger#Debug("GotOutput: " .. a:msg)
+    let l:session = get(s:sessions, a:buf, v:null)
+    if l:session is v:null
+        return
+    endif
+    let l:session.pending ..= a:msg
+    if l:session.flush_timer == -1
+        let l:session.flush_timer = timer_start(s:flush_interval, function('s:FlushOutput', [a:buf]))
+    endif
+endfunction
+
+" Function handling output from the shell: Add it above the prompt.
+function! s:GotErrors(channel, msg) abort
+    call ollama#logger#Debug("GotErrors: " .. a:msg)
+
+    let l:bufname = 'stderr'
+    let l:bufnr = bufnr(l:bufname)
+    if (l:bufnr != -1)
+        " buffer already exists
+        silent execute 'buffer' l:bufnr
     else
+        " create new error buffer
         silent execute 'new' l:bufname
     endif
-    " Set the filetype to ollama-chat
-"    setlocal filetype=ollama-chat
+
+    setlocal buftype=nofile
+    setlocal bufhidden=delete
+
+    call append(line("$"), a:msg)
+    stopinsert
+endfunction
+
+" Function handling the shell exits: turn the chat into a normal buffer.
+function! s:JobExit(buf, job, status) abort
+    call ollama#logger#Debug("JobExit: " .. a:status)
+    let l:session = get(s:sessions, a:buf, v:null)
+    if l:session is v:null || l:session.job isnot a:job
+        " the session was closed already
+        return
+    endif
+    " show the remaining output
+    call s:FlushOutput(a:buf, -1)
+    call s:CloseSession(l:session)
+    if a:status != 0
+        call ollama#status#End('chat:' .. a:buf, 'Chat exited with code ' .. a:status)
+    endif
+    if !bufexists(a:buf)
+        return
+    endif
+    " Turn off prompt functionality and make the buffer modifiable
+    call prompt_setprompt(a:buf, '')
+    call setbufvar(a:buf, '&buftype', '')
+    call setbufvar(a:buf, '&modifiable', 1)
+    " output info message
+    call appendbufline(a:buf, '$', "Chat process terminated with exit code " .. a:status)
+    call appendbufline(a:buf, '$', "Use ':q' or ':bd' to delete this buffer and run ':OllamaChat' again to create a new session.")
+    if bufnr('') == a:buf
+        stopinsert
+    endif
+    " avoid saving and make :q just work
+    call setbufvar(a:buf, '&modified', 0)
+endfunction
+
+" Wipes a left over buffer of a terminated chat with the given name
+function! s:WipeDeadBuffer(bufname) abort
+    let l:buf = bufnr('^' .. a:bufname .. '$')
+    if l:buf != -1 && !has_key(s:sessions, l:buf)
+        execute 'bwipeout!' l:buf
+    endif
+endfunction
+
+" Alternative chat implementation using a terminal window. Tokens are shown
+" as they arrive and the user can work in other windows meanwhile.
+function! s:StartTerminalChat(name) abort
+    let l:bufname = s:SessionBufName(a:name)
+    call s:WipeDeadBuffer(l:bufname)
+    let l:session = s:NewSession(a:name)
+    let l:command = s:ChatCommand(a:name) + [ '-i' ]
+    let l:term_options = {
+        \ 'term_name': l:bufname,
+        \ 'vertical': get(g:, 'ollama_split_vertically', 0) == 1,
+        \ }
+    let l:buf = term_start(l:command, l:term_options)
+    if l:buf == 0
+        echoerr "Failed to start chat terminal"
+        return v:null
+    endif
+    let l:session.buf = l:buf
+    let l:session.job = term_getjob(l:buf)
+    let l:session.terminal = 1
+    let s:sessions[l:buf] = l:session
+    setlocal bufhidden=delete
+    let b:coc_enabled = 0 " disable CoC in chat buffer
+    return l:session
+endfunction
+
+" Language hints of fenced code blocks which differ from the Vim filetype
+let s:fence_aliases = {
+    \ 'py': 'python', 'js': 'javascript', 'ts': 'typescript', 'bash': 'sh',
+    \ 'shell': 'sh', 'zsh': 'sh', 'rs': 'rust', 'yml': 'yaml', 'golang': 'go',
+    \ 'cxx': 'cpp', 'hpp': 'cpp', 'md': 'markdown', 'console': 'sh',
+    \ }
+
+" Returns the markdown_fenced_languages entry for a language hint, or '' if
+" Vim has no syntax file for it
+function! s:FencedLanguage(hint) abort
+    let l:ft = get(s:fence_aliases, a:hint, a:hint)
+    if l:ft ==# 'markdown' || empty(globpath(&runtimepath, 'syntax/' .. l:ft .. '.vim'))
+        return ''
+    endif
+    return l:ft ==# a:hint ? l:ft : a:hint .. '=' .. l:ft
+endfunction
+
+" (Re)loads the markdown syntax of the chat buffer with highlighting of the
+" fenced code blocks in the given languages. Sync from start, so the
+" highlighting is not confused by code blocks which are still streaming.
+function! s:LoadChatSyntax(buf, languages) abort
+    call setbufvar(a:buf, 'markdown_fenced_languages', a:languages)
+    let l:winid = bufwinid(a:buf)
+    if l:winid == -1
+        return
+    endif
+    " older syntax/markdown.vim only knows the global variable
+    let l:saved = get(g:, 'markdown_fenced_languages', [])
+    let g:markdown_fenced_languages = a:languages
+    try
+        call win_execute(l:winid, 'setlocal syntax=markdown | syntax sync fromstart')
+    finally
+        let g:markdown_fenced_languages = l:saved
+    endtry
+endfunction
+
+" Adds the languages of new fenced code blocks to the chat highlighting.
+" The languages are added when they show up, because including all syntax
+" files up front would be slow.
+function! s:UpdateChatSyntax(buf) abort
+    if !has('syntax') || !bufexists(a:buf)
+        return
+    endif
+    let l:languages = copy(getbufvar(a:buf, 'markdown_fenced_languages', []))
+    let l:changed = 0
+    for l:line in getbufline(a:buf, 1, '$')
+        let l:hint = tolower(matchstr(l:line, '^\s*```\s*\zs\w\+'))
+        if l:hint == '' || !empty(filter(copy(l:languages), {_, l -> l ==# l:hint || l =~# '^' .. l:hint .. '='}))
+            continue
+        endif
+        let l:entry = s:FencedLanguage(l:hint)
+        if l:entry != ''
+            call add(l:languages, l:entry)
+            let l:changed = 1
+        endif
+    endfor
+    if l:changed
+        call s:LoadChatSyntax(a:buf, l:languages)
+    endif
+endfunction
+
+" Creates a new chat buffer and starts the chat process
+function! s:StartPromptChat(name) abort
+    let l:bufname = s:SessionBufName(a:name)
+    call s:WipeDeadBuffer(l:bufname)
+    let l:session = s:NewSession(a:name)
+
+    let l:source_ft = &l:filetype
+
+    " Create new chat buffer
+    silent execute s:SplitCommand() .. 'new' fnameescape(l:bufname)
+    " The chat is markdown, this way also markdown plugins work in the chat
     setlocal filetype=markdown
     setlocal buftype=prompt
     " enable BufDelete event when closing buffer usig :q!
@@ -213,27 +639,47 @@ function! s:StartChat(lines) abort
     setlocal noswapfile
     setlocal modifiable
     setlocal wrap
+    if g:ollama_chat_reasoning ==# 'fold'
+        " chat.py prints the reasoning of the model between these markers
+        setlocal foldmethod=marker foldmarker=<think>,</think> foldlevel=0
+    endif
     let l:buf = bufnr('')
-    let s:buf = l:buf
+    let l:session.buf = l:buf
     let b:coc_enabled = 0 " disable CoC in chat buffer
+    if has('syntax')
+        " highlight code of the current filetype from the start
+        let l:entry = s:FencedLanguage(l:source_ft)
+        call s:LoadChatSyntax(l:buf, l:entry == '' ? [] : [l:entry])
+    endif
     " Create a channel log so we can see what happens.
-    if g:ollama_debug >= 4
+    if ollama#logger#Level() >= 4
         call ch_logfile(g:ollama_review_logfile, 'w')
     endif
 
+    " Redirect job's IO to buffer
+    let l:job_options = {
+        \ 'out_mode': 'raw',
+        \ 'out_cb': function('s:GotOutput', [l:buf]),
+        \ 'err_cb': function('s:GotErrors'),
+        \ 'exit_cb': function('s:JobExit', [l:buf]),
+        \ }
+
+    " Start a shell in the background.
+    let l:session.job = job_start(s:ChatCommand(a:name), l:job_options)
+    let s:sessions[l:buf] = l:session
+
     " Add a title to the chat buffer
     let l:title = "Chat with '" .. g:ollama_chat_model .. "' (via " .. g:ollama_chat_provider .. ")"
+    if !empty(a:name)
+        let l:title ..= " [" .. a:name .. "]"
+    endif
     call append(0, l:title)
     call append(1, repeat('-', len(l:title)))
     call append(2, "(type 'quit' to exit, press CTRL-C to interrupt output)")
-    if a:lines isnot v:null
-        call append(3, a:lines)
-        call ch_sendraw(s:job, join(a:lines, "\n") .. "\n")
-    endif
 
     " connect buffer with job
-    call prompt_setcallback(buf, function("TextEntered"))
-    eval prompt_setprompt(buf, ">>> ")
+    call prompt_setcallback(l:buf, function('s:TextEntered', [l:buf]))
+    eval prompt_setprompt(l:buf, ">>> ")
 
     " add key mapping for CTRL-C to terminate the chat script
     execute 'nnoremap <buffer> <C-C> :call ollama#review#KillChatBot()<CR>'
@@ -241,13 +687,74 @@ function! s:StartChat(lines) abort
 
     " buftype=prompt change modified. so reset it to easy to :q
     augroup ollama_chat_fix_modified
-      au!
       autocmd! TextChanged <buffer> setlocal nomodified
       autocmd! TextChangedI <buffer> setlocal nomodified
     augroup END
+    return l:session
+endfunction
+
+" Returns the source for a chat started from the current buffer, or v:null
+" if the current buffer is a chat.
+function! s:ChatSource() abort
+    if has_key(s:sessions, bufnr(''))
+        return v:null
+    endif
+    return {'buf': bufnr(''), 'first': 0, 'last': 0, 'lines': []}
+endfunction
 
-    " start accepting shell commands
-    startinsert
+" Returns the source for a chat about the given lines of the buffer. The
+" lines are kept for checking that they are unchanged when applying code.
+function! s:RangeSource(buf, first, last) abort
+    return {'buf': a:buf, 'first': a:first, 'last': a:last, 'lines': getbufline(a:buf, a:first, a:last)}
+endfunction
+
+" Switches to the chat session with the given name, or to the current session
+" if name is v:null. A new session is created if it does not exist. The given
+" lines are sent as prompt. Returns the session.
+function! s:StartChat(lines, name, source) abort
+    let l:session = a:name is v:null ? s:CurrentSession() : s:FindSession(a:name)
+    let l:new = l:session is v:null
+    if l:session isnot v:null && l:session.terminal && job_status(l:session.job) != 'run'
+        " the terminal chat has terminated, start a new one
+        call s:CloseSession(l:session)
+        let l:new = 1
+    endif
+    if l:new
+        let l:name = a:name is v:null ? '' : a:name
+        if g:ollama_chat_use_terminal && has('terminal')
+            let l:session = s:StartTerminalChat(l:name)
+        else
+            let l:session = s:StartPromptChat(l:name)
+        endif
+        if l:session is v:null
+            return v:null
+        endif
+        let s:last_buf = l:session.buf
+    else
+        call s:ShowSession(l:session)
+    endif
+    if a:source isnot v:null
+        " remember the buffer the chat was started from
+        let l:session.source = a:source
+    endif
+
+    " send lines
+    if a:lines isnot v:null
+        if l:session.terminal
+            call s:SendToTerminal(l:session, a:lines)
+        else
+            call append(line("$") - 1, a:lines)
+            let l:prompt = join(a:lines, "\n")
+            call ollama#logger#Debug("Sending prompt '" .. l:prompt .. "'...")
+            call ollama#throttle#Run('chat:' .. l:session.buf, function('s:SendPrompt', [l:session.buf, l:prompt]))
+        endif
+    endif
+
+    if l:new && !l:session.terminal
+        " start accepting shell commands
+        startinsert
+    endif
+    return l:session
 endfunction
 
 " Creates a chat window with the given prompt and copies the current selection
@@ -270,8 +777,92 @@ function! s:StartChatWithContext(prompt, start_line, end_line) abort
     " Debug output for prompt
     call ollama#logger#Debug("Prompt:\n"  ..  join(prompt_lines, "\n"))
 
+    let l:source = s:RangeSource(bufnr(''), a:start_line, a:end_line)
+
     " Start chat (ensure this function is defined elsewhere)
-    call s:StartChat(prompt_lines)
+    call s:StartChat(prompt_lines, v:null, l:source)
+endfunction
+
+" number of code lines sent before and after a diagnostic
+let s:diagnostic_context = 10
+let s:diagnostic_types = {'E': 'error', 'W': 'warning', 'I': 'info', 'N': 'note'}
+
+" Returns [list, index] of the quickfix or location list entry for the
+" cursor: the entry under the cursor in a quickfix window, otherwise the
+" location list or quickfix entry of the cursor line. Returns [[], -1] if
+" there is none.
+function! s:DiagnosticEntry() abort
+    if &buftype ==# 'quickfix'
+        let l:list = getwininfo(win_getid())[0].loclist ? getloclist(0) : getqflist()
+        let l:idx = line('.') - 1
+        " continuation lines belong to the entry before
+        while l:idx > 0 && !l:list[l:idx].valid
+            let l:idx -= 1
+        endwhile
+        if l:idx < 0 || l:idx >= len(l:list) || !l:list[l:idx].valid || l:list[l:idx].bufnr <= 0
+            return [[], -1]
+        endif
+        return [l:list, l:idx]
+    endif
+    for l:list in [getloclist(0), getqflist()]
+        let l:best = -1
+        for l:idx in range(len(l:list))
+            let l:entry = l:list[l:idx]
+            if l:entry.valid && l:entry.bufnr == bufnr('') && l:entry.lnum == line('.')
+                        \ && (l:best == -1 || abs(l:entry.col - col('.')) < abs(l:list[l:best].col - col('.')))
+                let l:best = l:idx
+            endif
+        endfor
+        if l:best != -1
+            return [l:list, l:best]
+        endif
+    endfor
+    return [[], -1]
+endfunction
+
+" Implements :OllamaExplain and :OllamaFix. Sends the diagnostic under the
+" cursor with the surrounding code to the chat. With a:fix the model is
+" asked for the corrected code, which can be applied using :OllamaApply.
+function! ollama#review#Diagnostic(fix) abort
+    let [l:list, l:idx] = s:DiagnosticEntry()
+    if l:idx == -1
+        echo "No quickfix or location list entry at the cursor."
+        return
+    endif
+    let l:entry = l:list[l:idx]
+    let l:message = [l:entry.text]
+    " add the continuation lines, e.g. notes of the compiler
+    let l:next = l:idx + 1
+    while l:next < len(l:list) && !l:list[l:next].valid
+        call add(l:message, l:list[l:next].text)
+        let l:next += 1
+    endwhile
+
+    let l:buf = l:entry.bufnr
+    call bufload(l:buf)
+    let l:file = fnamemodify(bufname(l:buf), ':.')
+    let l:lnum = max([l:entry.lnum, 1])
+    let l:first = max([1, l:lnum - s:diagnostic_context])
+    let l:last = min([len(getbufline(l:buf, 1, '$')), l:lnum + s:diagnostic_context])
+    let l:ft = getbufvar(l:buf, '&filetype')
+    let l:type = get(s:diagnostic_types, toupper(l:entry.type), 'problem')
+    let l:location = l:file .. ':' .. l:lnum .. (l:entry.col > 0 ? ':' .. l:entry.col : '')
+
+    if a:fix
+        let l:task = printf('Fix the following %s. Answer with the corrected code of lines %d-%d in a single code block, followed by a short explanation.', l:type, l:first, l:last)
+    else
+        let l:task = printf('Explain the following %s and how to fix it.', l:type)
+    endif
+    let l:prompt_lines = ['"""', l:task, '', l:location .. ': ' .. l:type .. ': ' .. l:message[0]]
+                \ + l:message[1:]
+                \ + ['', printf('Code of %s, lines %d-%d (the %s is in line %d):', l:file, l:first, l:last, l:type, l:lnum),
+                \    '```' .. (empty(l:ft) ? 'plaintext' : l:ft)]
+                \ + getbufline(l:buf, l:first, l:last) + ['```', '"""']
+    call ollama#logger#Debug("Prompt:\n" .. join(l:prompt_lines, "\n"))
+
+    " the code block of the answer can be applied with :OllamaApply
+    let l:source = s:RangeSource(l:buf, l:first, l:last)
+    call s:StartChat(l:prompt_lines, v:null, l:source)
 endfunction
 
 " Create chat with code review prompt
@@ -289,6 +880,259 @@ function! ollama#review#Task(prompt) range
     call s:StartChatWithContext(a:prompt, a:firstline, a:lastline)
 endfunction
 
-function ollama#review#Chat()
-    call s:StartChat(v:null)
+" Opens the chat session with the given name, or the default session
+function! ollama#review#Chat(...)
+    let l:parsed = ollama#options#Parse(a:000)
+    if l:parsed is v:null
+        return
+    endif
+    let [l:args, l:options] = l:parsed
+    let l:name = len(l:args) > 0 ? l:args[0] : ''
+    if !empty(l:options) && s:FindSession(l:name) isnot v:null
+        " the options are passed to the chat process on start
+        echohl WarningMsg
+        echom "The chat is already running, the options only apply to new chats."
+        echohl None
+    endif
+    let s:chat_options = l:options
+    call s:StartChat(v:null, l:name, s:ChatSource())
+    let s:chat_options = {}
+endfunction
+
+" Lists all active chat sessions
+function! ollama#review#ListSessions() abort
+    if empty(s:sessions)
+        echo "No active chat sessions."
+        return
+    endif
+    let l:current = s:CurrentSession()
+    for l:session in sort(values(s:sessions), {a, b -> a.buf - b.buf})
+        let l:status = type(l:session.job) == v:t_job ? job_status(l:session.job) : 'dead'
+        echo printf('%s %3d %-20s %-5s %s',
+              \ l:session is l:current ? '%' : ' ',
+              \ l:session.buf,
+              \ empty(l:session.name) ? '(default)' : l:session.name,
+              \ l:status,
+              \ l:session.terminal ? 'terminal' : 'prompt')
+    endfor
+endfunction
+
+" Switches to an existing chat session
+function! ollama#review#SwitchSession(name) abort
+    let l:name = a:name ==# '(default)' ? '' : a:name
+    let l:session = s:FindSession(l:name)
+    if l:session is v:null
+        echoerr "No chat session named '" .. a:name .. "'"
+        return
+    endif
+    call s:ShowSession(l:session)
+endfunction
+
+" Command line completion for chat session names
+function! ollama#review#SessionComplete(arglead, cmdline, cursorpos) abort
+    let l:names = map(values(s:sessions), {_, s -> empty(s.name) ? '(default)' : s.name})
+    return filter(sort(l:names), {_, name -> name =~# '^' .. escape(a:arglead, '\.*[]~^$')})
+endfunction
+
+" Returns the lines as fenced code block with filename and language. Large
+" contents get truncated to g:ollama_chat_attach_budget characters.
+function! s:FormatAttachment(lines, first, last) abort
+    let l:ft = &filetype !=# '' ? &filetype : 'plaintext'
+    let l:name = expand('%:.')
+    if empty(l:name)
+        let l:name = '[No Name]'
+    endif
+    let l:result = []
+    let l:size = 0
+    for l:line in a:lines
+        let l:size += len(l:line) + 1
+        if g:ollama_chat_attach_budget > 0 && l:size > g:ollama_chat_attach_budget
+            break
+        endif
+        call add(l:result, l:line)
+    endfor
+    let l:header = printf('File: %s (lines %d-%d, language: %s)', l:name, a:first, a:last, l:ft)
+    let l:block = [l:header, '```' .. l:ft] + l:result + ['```']
+    if len(l:result) < len(a:lines)
+        call add(l:block, printf('Note: the content was truncated after %d of %d lines.', len(l:result), len(a:lines)))
+        call ollama#logger#Info("Attachment truncated to " .. len(l:result) .. " lines")
+    endif
+    return l:block
+endfunction
+
+" Attaches the given lines of the current buffer as context to the chat.
+" The context gets sent together with the next message, so you can ask
+" questions about it.
+function! ollama#review#Attach(first, last) abort
+    if has_key(s:sessions, bufnr(''))
+        echoerr "Cannot attach the chat buffer itself"
+        return
+    endif
+    let l:lines = getline(a:first, a:last)
+    let l:block = s:FormatAttachment(l:lines, a:first, a:last)
+    let l:info = l:block[0]
+    let l:source = s:RangeSource(bufnr(''), a:first, a:last)
+
+    if g:ollama_chat_use_terminal && has('terminal')
+        " the terminal chat has no hook for the next message, so send the
+        " context right away
+        call s:StartChat(['"""', 'Use the following code as context for my next questions.'] + l:block + ['"""'], v:null, l:source)
+        return
+    endif
+
+    let l:session = s:StartChat(v:null, v:null, l:source)
+    if l:session is v:null
+        return
+    endif
+    let l:session.attachment = l:block
+    call append(line("$") - 1, "Attached " .. l:info[6:] .. ". It is sent with your next message.")
+endfunction
+
+" Returns all fenced code blocks of the chat buffer as list of dicts
+" with the keys 'start', 'end', 'lang' and 'lines'.
+function! s:GetCodeBlocks() abort
+    let l:blocks = []
+    let l:block = v:null
+    let l:lnum = 1
+    for l:line in getline(1, '$')
+        if l:block is v:null
+            let l:match = matchlist(l:line, '^\s*```\s*\([[:alnum:]_+#.-]*\)')
+            if !empty(l:match)
+                let l:block = {'start': l:lnum, 'lang': l:match[1], 'lines': []}
+            endif
+        elseif l:line =~ '^\s*```\s*$'
+            let l:block.end = l:lnum
+            call add(l:blocks, l:block)
+            let l:block = v:null
+        else
+            call add(l:block.lines, l:line)
+        endif
+        let l:lnum += 1
+    endfor
+    return l:blocks
+endfunction
+
+" Lets the user choose one of the code blocks. Returns v:null if aborted.
+function! s:SelectCodeBlock(blocks) abort
+    " prefer the block under the cursor
+    for l:block in a:blocks
+        if line('.') >= l:block.start && line('.') <= l:block.end
+            return l:block
+        endif
+    endfor
+    if len(a:blocks) == 1
+        return a:blocks[0]
+    endif
+    let l:choices = ['Select code block:']
+    let l:idx = 1
+    for l:block in a:blocks
+        let l:first = trim(get(l:block.lines, 0, ''))
+        call add(l:choices, printf('%d. [%s] line %d: %s', l:idx,
+              \ empty(l:block.lang) ? '-' : l:block.lang, l:block.start, l:first))
+        let l:idx += 1
+    endfor
+    let l:ans = inputlist(l:choices)
+    if l:ans < 1 || l:ans > len(a:blocks)
+        return v:null
+    endif
+    return a:blocks[l:ans - 1]
+endfunction
+
+" Changes the indentation of the lines, so that the least indented line
+" gets the given indent.
+function! s:Reindent(lines, indent) abort
+    " the leading whitespace shared by all non-blank lines, compared as
+    " strings, so that tabs and spaces don't get mixed up
+    let l:common = v:null
+    for l:line in a:lines
+        if l:line =~ '\S'
+            let l:lead = matchstr(l:line, '^\s*')
+            if l:common is v:null
+                let l:common = l:lead
+            else
+                let l:n = 0
+                while l:n < len(l:common) && l:n < len(l:lead) && l:common[l:n] ==# l:lead[l:n]
+                    let l:n += 1
+                endwhile
+                let l:common = strpart(l:common, 0, l:n)
+            endif
+        endif
+    endfor
+    let l:strip = l:common is v:null ? 0 : len(l:common)
+    let l:prefix = &expandtab ? repeat(' ', a:indent) : repeat("\t", a:indent / &tabstop) .. repeat(' ', a:indent % &tabstop)
+    return map(copy(a:lines), {_, line -> line =~ '\S'
+          \ ? l:prefix .. strpart(line, l:strip)
+          \ : ''})
+endfunction
+
+" Applies a code block of the chat to the buffer the chat was started from.
+" If the chat was started with a range (e.g. :OllamaReview) this range gets
+" replaced, otherwise the code is inserted below the cursor. If the range
+" was edited meanwhile, the user is asked to insert the code instead. If a
+" range of the chat buffer is given, it is used instead of a code block.
+function! ollama#review#ApplyCodeBlock() range abort
+    let l:session = get(s:sessions, bufnr(''), v:null)
+    if l:session is v:null
+        echoerr "Not in an Ollama Chat buffer"
+        return
+    endif
+    let l:source = l:session.source
+    if a:firstline != a:lastline
+        " use the selected lines, but without fences
+        let l:block = {'lang': '', 'lines': filter(getline(a:firstline, a:lastline), {_, line -> line !~ '^\s*```'})}
+    else
+        let l:blocks = s:GetCodeBlocks()
+        if empty(l:blocks)
+            echo "The chat does not contain any code blocks."
+            return
+        endif
+        let l:block = s:SelectCodeBlock(l:blocks)
+        if l:block is v:null
+            return
+        endif
+    endif
+
+    if !bufexists(l:source.buf)
+        echoerr "The source buffer of this chat does not exist anymore"
+        return
+    endif
+    let l:ft = getbufvar(l:source.buf, '&filetype')
+    if !empty(l:block.lang) && !empty(l:ft) && l:block.lang !=? l:ft
+        let l:ans = confirm("The code block is '" .. l:block.lang .. "', but the buffer is '" .. l:ft .. "'.", "&Apply\n&Cancel", 2)
+        if l:ans != 1
+            return
+        endif
+    endif
+
+    " switch to the source window
+    let l:winid = get(win_findbuf(l:source.buf), 0, -1)
+    if l:winid == -1
+        execute 'sbuffer' l:source.buf
+    else
+        call win_gotoid(l:winid)
+    endif
+
+    let l:replace = l:source.first > 0
+    if l:replace && getline(l:source.first, l:source.last) !=# l:source.lines
+        " the user edited the buffer, the range may contain other code now
+        let l:ans = confirm(printf("Lines %d-%d were changed since they were sent to the chat.", l:source.first, l:source.last),
+                    \ "&Insert below cursor\n&Cancel", 2)
+        if l:ans != 1
+            return
+        endif
+        let l:replace = 0
+    endif
+    if l:replace
+        " replace the range which was sent to the chat
+        let l:lines = s:Reindent(l:block.lines, indent(l:source.first))
+        call deletebufline('', l:source.first, l:source.last)
+        call append(l:source.first - 1, l:lines)
+        let l:source.last = l:source.first + len(l:lines) - 1
+        let l:source.lines = l:lines
+        call cursor(l:source.first, 1)
+    else
+        let l:lines = s:Reindent(l:block.lines, indent('.'))
+        call append(line('.'), l:lines)
+    endif
+    call ollama#logger#Debug("Applied code block with " .. len(l:lines) .. " lines")
 endfunction
@@ -18,7 +18,8 @@ function! ollama#setup#GetModels(url)
     endif
     " Construct the shell command to call list_models.py with the provided URL
     let l:script_path = printf('%s/python/list_models.py', g:ollama_plugin_dir)
-    let l:command = [ g:ollama_python_interpreter, l:script_path, '-u', shellescape(a:url), l:null_redirect ]
+    let l:command = [ g:ollama_python_interpreter, l:script_path, '-u', shellescape(a:url) ]
+                \ + map(ollama#connection#Args(), {_, a -> shellescape(a)}) + [ l:null_redirect ]
     " list to string conversion
     let l:command = join(l:command, ' ')
 
@@ -100,13 +101,23 @@ function! s:PullExitCallback(job_id, exit_code)
 
     " Clear the pull job reference
     let s:pull_job = v:null
+
+    " Notify the caller
+    if exists('s:pull_callback') && s:pull_callback isnot v:null
+        let l:Callback = s:pull_callback
+        let s:pull_callback = v:null
+        call l:Callback(a:exit_code)
+    endif
 endfunction
 
-" Pulls the given model in Ollama asynchronously
-function! ollama#setup#PullModel(url, model)
+" Pulls the given model in Ollama asynchronously. The optional callback is
+" called with the exit code when the pull has finished.
+function! ollama#setup#PullModel(url, model, ...)
+    let s:pull_callback = a:0 > 0 ? a:1 : v:null
     " Construct the shell command to call the Python script
     let l:script_path = printf('%s/python/pull_model.py', g:ollama_plugin_dir)
     let l:command = [ g:ollama_python_interpreter, l:script_path, '-u', a:url, '-m', a:model ]
+                \ + ollama#connection#Args()
 
     " Log the command being run
     call ollama#logger#Debug("command=" .. join(l:command, " "))
@@ -303,6 +314,8 @@ function! s:FinalizeSetupTask()
                 \ "let g:ollama_model = '" .. g:ollama_model .. "'",
                 \ "\" number of context lines to use for code completion",
                 \ "\"let g:ollama_context_lines = 10",
+                \ "\" number of recently used files to add as completion context",
+                \ "\"let g:ollama_context_files = 3",
                 \ "\" debounce time to wait before triggering a completion",
                 \ "\"let g:ollama_debounce_time = 300",
                 \ "\" If you want to enable completion for a limited set of",
@@ -310,7 +323,7 @@ function! s:FinalizeSetupTask()
                 \ "\"let g:ollama_completion_allowlist_filetype = []",
                 \ "\" If you do not want to run completion for certain ",
                 \ "\" filetypes, list them here.",
-                \ "\"let g:ollama_completion_denylist_filetype = []",
+                \ "\"let g:ollama_completion_denylist_filetype = ['gitcommit', 'gitrebase', 'help']",
                 \ "",
                 \ "\" chat model",
                 \ "let g:ollama_chat_model = '" .. g:ollama_chat_model .. "'",
@@ -0,0 +1,136 @@
+" SPDX-License-Identifier: GPL-3.0-or-later
+" SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
+"
+" Statusline integration: shows the active model, a spinner while requests
+" are pending and an error state when the last request failed.
+" The statusline only gets redrawn when the state changes, and while a
+" request is pending for animating the spinner.
+scriptencoding utf-8
+
+" pending requests, e.g. 'completion' or 'chat:<bufnr>'
+let s:pending = {}
+" error message of the last failed request
+let s:error = ''
+" reason why requests are throttled, see throttle.vim
+let s:throttled = ''
+let s:frame = 0
+let s:spinner_timer = -1
+let s:spinner_interval = 150
+if &encoding ==# 'utf-8'
+    let s:frames = ['⠋', '⠙', '⠹', '⠸', '⠼', '⠴', '⠦', '⠧', '⠇', '⠏']
+else
+    let s:frames = ['|', '/', '-', '\']
+endif
+let s:throttled_indicator = &encoding ==# 'utf-8' ? '⏸' : '='
+
+" Notifies statusline plugins like lightline about the new state
+function! s:Changed() abort
+    if exists('#User#OllamaStatusChanged')
+        doautocmd <nomodeline> User OllamaStatusChanged
+    endif
+    redrawstatus!
+endfunction
+
+function! s:Spin(timer) abort
+    if empty(s:pending)
+        call timer_stop(a:timer)
+        let s:spinner_timer = -1
+        return
+    endif
+    let s:frame = (s:frame + 1) % len(s:frames)
+    redrawstatus!
+endfunction
+
+" Marks a request as pending
+function! ollama#status#Begin(key) abort
+    let l:changed = empty(s:pending)
+    let s:pending[a:key] = 1
+    if get(g:, 'ollama_statusline_spinner', 1) && s:spinner_timer == -1
+        let s:spinner_timer = timer_start(s:spinner_interval, function('s:Spin'), {'repeat': -1})
+    endif
+    if l:changed
+        call s:Changed()
+    endif
+endfunction
+
+" Marks a request as done. The optional argument is an error message,
+" otherwise the error state gets cleared.
+function! ollama#status#End(key, ...) abort
+    let l:error = a:0 > 0 ? a:1 : ''
+    if !has_key(s:pending, a:key) && (empty(l:error) || l:error ==# s:error)
+        return
+    endif
+    silent! call remove(s:pending, a:key)
+    let s:error = l:error
+    call s:Changed()
+endfunction
+
+" Returns the name of the model used in the window whose statusline is
+" drawn: the chat model in chat buffers, otherwise the completion model
+function! ollama#status#Model() abort
+    let l:buf = winbufnr(get(g:, 'statusline_winid', win_getid()))
+    let l:kind = ollama#model#ContextKind(l:buf)
+    if l:kind ==# 'completion'
+        " the project config may override the model
+        return get(ollama#project#Config(l:buf), 'model', g:ollama_model)
+    endif
+    return ollama#model#Get(l:kind)
+endfunction
+
+" Returns 1 while a completion or chat request is pending
+function! ollama#status#IsPending() abort
+    return !empty(s:pending)
+endfunction
+
+" Returns the keys of the pending requests
+function! ollama#status#Pending() abort
+    return keys(s:pending)
+endfunction
+
+" Sets the reason why requests are throttled, '' when they are not
+function! ollama#status#SetThrottled(reason) abort
+    if s:throttled !=# a:reason
+        let l:changed = empty(s:throttled) != empty(a:reason)
+        let s:throttled = a:reason
+        if l:changed
+            call s:Changed()
+        endif
+    endif
+endfunction
+
+" Returns the reason why requests are throttled, or ''
+function! ollama#status#Throttled() abort
+    return s:throttled
+endfunction
+
+" Returns the error message of the last failed request, or ''
+function! ollama#status#Error() abort
+    return s:error
+endfunction
+
+" Returns a spinner while requests are pending, a pause sign while
+" throttled requests wait, or '!' if the last request failed.
+" Returns '' when idle.
+function! ollama#status#Indicator() abort
+    if !empty(s:pending)
+        return get(g:, 'ollama_statusline_spinner', 1) ? s:frames[s:frame] : '*'
+    endif
+    if !empty(s:throttled)
+        return s:throttled_indicator
+    endif
+    return empty(s:error) ? '' : '!'
+endfunction
+
+" Returns the status for a plain statusline, e.g. 'ollama:codellama ⠹'
+function! ollama#status#Statusline() abort
+    let l:model = ollama#status#Model()
+    if empty(l:model)
+        return ''
+    endif
+    let l:text = 'ollama:' .. l:model
+    if !ollama#IsEnabled(winbufnr(get(g:, 'statusline_winid', win_getid())))
+        let l:text ..= ' (off)'
+    endif
+    let l:indicator = ollama#status#Indicator()
+    return empty(l:indicator) ? l:text : l:text .. ' ' .. l:indicator
+endfunction
@@ -0,0 +1,139 @@
+" SPDX-License-Identifier: GPL-3.0-or-later
+" SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
+"
+" Limits the requests to the LLM server, which protects shared servers and
+" avoids rate limit errors (HTTP 429) of hosted providers.
+" g:ollama_max_concurrent_requests limits the requests in flight and
+" g:ollama_completion_rate_limit spaces out the completion requests.
+" Completions are only delayed by restarting their timer, so a newer
+" completion trigger replaces a waiting one. Chat messages are user
+" requests, they are queued and never dropped. Edits are not queued, but
+" count as requests in flight.
+scriptencoding utf-8
+
+" interval in ms for checking again if a completion can be sent
+let s:poll_interval = 250
+" start time of the last completion request
+let s:last_completion = v:null
+" queued user requests: [key, Callback]
+let s:queue = []
+" statistics for :OllamaDebugInfo
+let s:delayed = 0
+let s:queued = 0
+
+" Returns the number of requests in flight, without the given key. A chat
+" whose process is gone has no request in flight, even if the response
+" never ended.
+function! s:InFlight(key) abort
+    return len(filter(ollama#status#Pending(), {_, k -> k !=# a:key
+        \ && (k !~# '^chat:' || ollama#review#IsRunning(str2nr(k[5:])))}))
+endfunction
+
+function! s:HasSlot(key) abort
+    let l:limit = get(g:, 'ollama_max_concurrent_requests', 0)
+    return l:limit <= 0 || s:InFlight(a:key) < l:limit
+endfunction
+
+" Returns the time in ms to wait before the next completion request can be
+" sent, or 0 if it can be sent now. The running completion gets replaced, so
+" it doesn't count as request in flight.
+function! ollama#throttle#CompletionDelay() abort
+    if !empty(s:queue) || !s:HasSlot('completion')
+        " user requests go first
+        let l:reason = 'completion waits for ' .. s:InFlight('completion') .. ' requests in flight'
+        let l:delay = s:poll_interval
+    else
+        let l:rate = get(g:, 'ollama_completion_rate_limit', 0)
+        let l:elapsed = s:last_completion is v:null ? 60000 : float2nr(reltimefloat(reltime(s:last_completion)) * 1000)
+        let l:delay = l:rate > 0 ? 60000 / l:rate - l:elapsed : 0
+        let l:reason = 'completion rate limit of ' .. l:rate .. ' per minute'
+    endif
+    if l:delay <= 0
+        return 0
+    endif
+    call ollama#logger#Debug("Throttled: " .. l:reason .. ", retrying in " .. l:delay .. " ms")
+    if ollama#status#Throttled() ==# ''
+        let s:delayed += 1
+    endif
+    call ollama#status#SetThrottled(l:reason)
+    return l:delay
+endfunction
+
+" Must be called when a completion request is sent
+function! ollama#throttle#CompletionStarted() abort
+    let s:last_completion = reltime()
+    call ollama#status#SetThrottled('')
+endfunction
+
+" Must be called when a waiting completion got dropped, because the user
+" kept typing or left insert mode
+function! ollama#throttle#CompletionDropped() abort
+    if empty(s:queue)
+        call ollama#status#SetThrottled('')
+    endif
+endfunction
+
+" Runs the user request with the given status key now, or when one of the
+" requests in flight finished. A running completion is cancelled to make
+" room, because it can be requested again.
+function! ollama#throttle#Run(key, Callback) abort
+    if empty(s:queue) && !s:HasSlot(a:key) && index(ollama#status#Pending(), 'completion') != -1
+        call ollama#Clear()
+    endif
+    if empty(s:queue) && s:HasSlot(a:key)
+        call a:Callback()
+        return
+    endif
+    call add(s:queue, [a:key, a:Callback])
+    let s:queued += 1
+    call ollama#logger#Info("Throttled: " .. s:QueueReason())
+    call ollama#status#SetThrottled(s:QueueReason())
+    echo "Waiting for " .. s:InFlight(a:key) .. " requests in flight (g:ollama_max_concurrent_requests)..."
+    augroup ollama_throttle
+        autocmd!
+        autocmd User OllamaStatusChanged call s:RunQueued()
+    augroup END
+endfunction
+
+" Removes the queued requests of the key, e.g. of a closed chat
+function! ollama#throttle#Cancel(key) abort
+    let l:count = len(s:queue)
+    call filter(s:queue, {_, r -> r[0] !=# a:key})
+    if l:count > 0 && empty(s:queue)
+        call s:StopQueue()
+    endif
+endfunction
+
+function! s:QueueReason() abort
+    return len(s:queue) .. ' queued, ' .. s:InFlight(s:queue[0][0]) .. ' requests in flight'
+endfunction
+
+function! s:StopQueue() abort
+    autocmd! ollama_throttle
+    call ollama#status#SetThrottled('')
+endfunction
+
+" Starts the queued requests when requests in flight are done
+function! s:RunQueued() abort
+    while !empty(s:queue) && s:HasSlot(s:queue[0][0])
+        let [l:key, l:Callback] = remove(s:queue, 0)
+        call ollama#logger#Debug("Running queued request " .. l:key)
+        call l:Callback()
+        if empty(s:queue)
+            call s:StopQueue()
+        else
+            call ollama#status#SetThrottled(s:QueueReason())
+        endif
+    endwhile
+endfunction
+
+" Returns the settings and statistics for :OllamaDebugInfo
+function! ollama#throttle#Info() abort
+    return [
+        \ 'max. concurrent requests: ' .. get(g:, 'ollama_max_concurrent_requests', 0),
+        \ 'completion rate limit: ' .. get(g:, 'ollama_completion_rate_limit', 0) .. ' per minute',
+        \ 'requests in flight: ' .. join(ollama#status#Pending(), ', '),
+        \ 'delayed completions: ' .. s:delayed,
+        \ 'queued requests: ' .. s:queued .. ' (' .. len(s:queue) .. ' waiting)',
+        \ ]
+endfunction
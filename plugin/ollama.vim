@@ -6,15 +6,41 @@ if exists('g:loaded_ollama')
 endif
 let g:loaded_ollama = 1
 
+" Shows why a mapping of the plugin does nothing
+function! s:Disabled() abort
+    echohl WarningMsg
+    echo "Vim-ollama is disabled, see :messages for the reason."
+    echohl None
+endfunction
+
+" Defines fallback <Plug> mappings when the plugin is disabled, so that the
+" mappings of the user don't break: <Tab> still inserts a tab and the other
+" mappings show a message.
+function! s:DefineFallbackPlugs() abort
+    inoremap <Plug>(ollama-tab-completion) <Tab>
+    inoremap <Plug>(ollama-dismiss)        <Nop>
+    for l:name in ['trigger-completion', 'insert-line', 'insert-word', 'next-candidate', 'prev-candidate']
+        execute 'inoremap <Plug>(ollama-' .. l:name .. ') <Cmd>call <SID>Disabled()<CR>'
+    endfor
+    for l:name in ['attach', 'toggle', 'accept-changes', 'reject-changes', 'accept-all-changes', 'reject-all-changes', 'edit']
+        execute 'nnoremap <Plug>(ollama-' .. l:name .. ') <Cmd>call <SID>Disabled()<CR>'
+    endfor
+    for l:name in ['review', 'attach', 'edit', 'refactor']
+        execute 'vnoremap <Plug>(ollama-' .. l:name .. ') <Cmd>call <SID>Disabled()<CR>'
+    endfor
+endfunction
+
 if v:version < 800 || !exists('##InsertLeavePre')
     let g:ollama_enabled = 0
     echom "warning: your Vim version is too old. Vim-ollama is disabled."
+    call s:DefineFallbackPlugs()
     finish
 endif
 
 if has('nvim')
     let g:ollama_enabled = 0
     echom "warning: This plugin does not support NeoVim. Vim-ollama is disabled."
+    call s:DefineFallbackPlugs()
     finish
 endif
 
@@ -24,12 +50,14 @@ if has('python3') || has('python3_dynamic')
 else
     let g:ollama_enabled = 0
     echom "warning: your Vim version does not support python3. Vim-ollama is disabled."
+    call s:DefineFallbackPlugs()
     finish
 endif
 
 if has('win32') && $PYTHONUTF8 ==# ''
     let g:ollama_enabled = 0
     echom "warning: PYTHONUTF8=1 is required on Windows. Vim-ollama is disabled."
+    call s:DefineFallbackPlugs()
     finish
 endif
 
@@ -67,19 +95,91 @@ if !exists('g:ollama_openai_credentialname')
     " UNIX Pass credential name to lookup API key for OpenAI service
     let g:ollama_openai_credentialname = ''
 endif
+if !exists('g:ollama_statusline_spinner')
+    " Animate the statusline indicator while requests are pending
+    let g:ollama_statusline_spinner = 1
+endif
+if !exists('g:ollama_ca_bundle')
+    " CA bundle for verifying the certificate of the Ollama server
+    let g:ollama_ca_bundle = ''
+endif
+if !exists('g:ollama_tls_insecure')
+    " Don't verify the certificate of the Ollama server (self-signed certs)
+    let g:ollama_tls_insecure = 0
+endif
+if !exists('g:ollama_auth')
+    " Authorization header for the Ollama server: 'bearer', 'basic' or ''
+    let g:ollama_auth = ''
+endif
+if !exists('g:ollama_connect_timeout')
+    " Timeout in seconds for connecting to the Ollama server
+    let g:ollama_connect_timeout = 10
+endif
+if !exists('g:ollama_retries')
+    " Number of retries on connection errors and busy servers
+    let g:ollama_retries = 2
+endif
+if !exists('g:ollama_max_concurrent_requests')
+    " max. number of requests in flight, 0 means unlimited
+    let g:ollama_max_concurrent_requests = 0
+endif
+if !exists('g:ollama_completion_rate_limit')
+    " max. number of completion requests per minute, 0 means unlimited
+    let g:ollama_completion_rate_limit = 0
+endif
+if !exists('g:ollama_auth_credentialname')
+    " UNIX Pass credential name to lookup the Ollama token
+    let g:ollama_auth_credentialname = ''
+endif
 " Tab completion specific settings
 if !exists('g:ollama_debounce_time')
     let g:ollama_debounce_time = 500
 endif
+if !exists('g:ollama_trigger_mode')
+    " 'auto': complete while typing, 'chars': only after g:ollama_trigger_chars,
+    " 'manual': only on <Plug>(ollama-trigger-completion) or :OllamaComplete
+    let g:ollama_trigger_mode = 'auto'
+endif
+if !exists('g:ollama_trigger_chars')
+    let g:ollama_trigger_chars = ['.', '(', '[', '{', ',', '=', ':', '->']
+endif
 if !exists('g:ollama_completion_allowlist_filetype')
   let g:ollama_completion_allowlist_filetype = []
 endif
 if !exists('g:ollama_completion_denylist_filetype')
-  let g:ollama_completion_denylist_filetype = []
+  let g:ollama_completion_denylist_filetype = ['gitcommit', 'gitrebase', 'help']
+endif
+if !exists('g:ollama_pull_missing_model')
+    " pull a missing completion model: 'ask', 'always' or 'never'
+    let g:ollama_pull_missing_model = 'ask'
+endif
+if !exists('g:ollama_completion_candidates')
+    " number of completion candidates to request
+    let g:ollama_completion_candidates = 1
+endif
+if !exists('g:ollama_completion_cache_size')
+    " max. number of cached completions (0=off)
+    let g:ollama_completion_cache_size = 100
+endif
+if !exists('g:ollama_completion_cache_ttl')
+    " time in seconds until a cached completion expires
+    let g:ollama_completion_cache_ttl = 300
 endif
 if !exists('g:ollama_context_lines')
     let g:ollama_context_lines = 30
 endif
+if !exists('g:ollama_project_config')
+    " name of the project config file, empty disables the project config
+    let g:ollama_project_config = '.ollama.json'
+endif
+if !exists('g:ollama_context_files')
+    " number of recently used files added as completion context (0=off)
+    let g:ollama_context_files = 0
+endif
+if !exists('g:ollama_context_budget')
+    " max. number of bytes read from context files
+    let g:ollama_context_budget = 4096
+endif
 if !exists('g:ollama_model_provider')
     " Provider for code completions: 'ollama' or 'openai'
     let g:ollama_model_provider = 'ollama'
@@ -88,6 +188,50 @@ if !exists('g:ollama_model')
     " default code completion model
     let g:ollama_model = 'codellama:code'
 endif
+if !exists('g:ollama_fim_config_dir')
+    " Directory with user FIM configs, which override the built-in configs
+    let g:ollama_fim_config_dir = ''
+endif
+if !exists('g:ollama_fim_fallback')
+    " Use Ollama's template or prefix-only completion without FIM config
+    let g:ollama_fim_fallback = 1
+endif
+if !exists('g:ollama_completion_suffix_hint')
+    " Add the code after the cursor as hint for models without FIM support
+    let g:ollama_completion_suffix_hint = 0
+endif
+if !exists('g:ollama_skip_duplicate_closers')
+    " Don't insert closing brackets and quotes which are already after the cursor
+    let g:ollama_skip_duplicate_closers = 0
+endif
+if !exists('g:ollama_suspend_in_macros')
+    " no completions while recording or executing macros and in paste mode
+    let g:ollama_suspend_in_macros = 1
+endif
+if !exists('g:ollama_warmup')
+    " load the completion model in the background when Vim starts
+    let g:ollama_warmup = 0
+endif
+if !exists('g:ollama_keep_alive')
+    " how long Ollama keeps the completion model loaded, empty uses the server default
+    let g:ollama_keep_alive = ''
+endif
+if !exists('g:ollama_comment_to_code')
+    " implement the comment above the cursor instead of filling in the middle
+    let g:ollama_comment_to_code = 0
+endif
+if !exists('g:ollama_completion_seed')
+    " seed for reproducible completions, empty means random
+    let g:ollama_completion_seed = ''
+endif
+if !exists('g:ollama_reasoning_delimiters')
+    " delimiters of the reasoning blocks of reasoning models, which are stripped
+    let g:ollama_reasoning_delimiters = [['<think>', '</think>']]
+endif
+if !exists('g:ollama_max_num_ctx')
+    " upper bound of the automatically computed context window size
+    let g:ollama_max_num_ctx = 8192
+endif
 if !exists('g:ollama_model_options')
     " default model options for code completion
     " Predict less -> faster response time
@@ -111,6 +255,10 @@ if !exists('g:ollama_chat_systemprompt')
     " empty means no system prompt, we use th built-in one
     let g:ollama_chat_systemprompt = ''
 endif
+if !exists('g:ollama_chat_systemprompt_file')
+    " project file which overrides the system prompt
+    let g:ollama_chat_systemprompt_file = '.ollama-systemprompt'
+endif
 if !exists('g:ollama_chat_options')
     " default model options for chats
     " we need more prediction for larger tasks
@@ -122,6 +270,29 @@ endif
 if !exists('g:ollama_chat_timeout')
     let g:ollama_chat_timeout = 10
 endif
+if !exists('g:ollama_chat_use_terminal')
+    " run the chat in a terminal window instead of a prompt buffer
+    let g:ollama_chat_use_terminal = 0
+endif
+if !exists('g:ollama_chat_stats')
+    " show token and timing statistics after each chat response
+    let g:ollama_chat_stats = 0
+endif
+if !exists('g:ollama_chat_reasoning')
+    " reasoning of reasoning models in the chat: 'show', 'fold' or 'hide'
+    let g:ollama_chat_reasoning = 'fold'
+endif
+if !exists('g:ollama_chat_history')
+    " save chat conversations per project, so they can be restored
+    let g:ollama_chat_history = 1
+endif
+if !exists('g:ollama_chat_history_dir')
+    let g:ollama_chat_history_dir = (empty($XDG_STATE_HOME) ? expand('~/.local/state') : $XDG_STATE_HOME) .. '/vim-ollama/chats'
+endif
+if !exists('g:ollama_chat_attach_budget')
+    " max. number of characters attached to the chat by :OllamaAttach
+    let g:ollama_chat_attach_budget = 16000
+endif
 " Code edit specific settings
 if !exists('g:ollama_edit_provider')
     " Provider for edit models: 'ollama' or 'openai'
@@ -196,28 +367,38 @@ function! s:HandleTabCompletion() abort
     endif
 endfunction
 
+" Create plugs at load time, so they can be used in the vimrc no matter
+" if it gets sourced before or after the plugin.
+inoremap <Plug>(ollama-trigger-completion) <Cmd>call ollama#TriggerCompletion()<CR>
+inoremap <Plug>(ollama-dismiss)        <Cmd>call ollama#Dismiss()<CR>
+inoremap <Plug>(ollama-tab-completion) <C-R>=<SID>HandleTabCompletion()<CR>
+inoremap <Plug>(ollama-insert-line)    <Cmd>call ollama#InsertNextLine()<CR>
+inoremap <Plug>(ollama-insert-word)    <Cmd>call ollama#InsertNextWord()<CR>
+inoremap <Plug>(ollama-next-candidate) <Cmd>call ollama#CycleCandidate(1)<CR>
+inoremap <Plug>(ollama-prev-candidate) <Cmd>call ollama#CycleCandidate(-1)<CR>
+vnoremap <Plug>(ollama-review)         :call ollama#review#Review()<CR>
+nnoremap <Plug>(ollama-attach)         <Cmd>%OllamaAttach<CR>
+vnoremap <Plug>(ollama-attach)         :OllamaAttach<CR>
+nnoremap <Plug>(ollama-toggle)         <Cmd>call ollama#Toggle()<CR>
+nnoremap <Plug>(ollama-accept-changes) <Cmd>call ollama#edit#AcceptCurrent()<CR>
+nnoremap <Plug>(ollama-reject-changes) <Cmd>call ollama#edit#RejectCurrent()<CR>
+nnoremap <Plug>(ollama-accept-all-changes) <Cmd>call ollama#edit#AcceptAll()<CR>
+nnoremap <Plug>(ollama-reject-all-changes) <Cmd>call ollama#edit#RejectAll()<CR>
+nnoremap <Plug>(ollama-edit)           :call ollama#edit#EditPrompt()<CR>
+vnoremap <Plug>(ollama-edit)           :call ollama#edit#EditPrompt()<CR>
+vnoremap <Plug>(ollama-refactor)       :call ollama#edit#Refactor('')<CR>
+
 " Map <Tab> to insert suggestion
 function! s:MapTab() abort
-    " Create plugs
-    inoremap <Plug>(ollama-trigger-completion) <Cmd>call ollama#TriggerCompletion()<CR>
-    inoremap <Plug>(ollama-dismiss)        <Cmd>call ollama#Dismiss()<CR>
-    inoremap <Plug>(ollama-tab-completion) <C-R>=<SID>HandleTabCompletion()<CR>
-    inoremap <Plug>(ollama-insert-line)    <Cmd>call ollama#InsertNextLine()<CR>
-    inoremap <Plug>(ollama-insert-word)    <Cmd>call ollama#InsertNextWord()<CR>
-    vnoremap <Plug>(ollama-review)         :call ollama#review#Review()<CR>
-    nnoremap <Plug>(ollama-toggle)         <Cmd>call ollama#Toggle()<CR>
-    nnoremap <Plug>(ollama-accept-changes) <Cmd>call ollama#edit#AcceptCurrent()<CR>
-    nnoremap <Plug>(ollama-reject-changes) <Cmd>call ollama#edit#RejectCurrent()<CR>
-    nnoremap <Plug>(ollama-accept-all-changes) <Cmd>call ollama#edit#AcceptAll()<CR>
-    nnoremap <Plug>(ollama-reject-all-changes) <Cmd>call ollama#edit#RejectAll()<CR>
-    nnoremap <Plug>(ollama-edit)           :call ollama#edit#EditPrompt()<CR>
-    vnoremap <Plug>(ollama-edit)           :call ollama#edit#EditPrompt()<CR>
-
     if !exists('g:ollama_no_tab_map')
         " Save the existing <Tab> mapping in insert mode
         if !exists('g:ollama_original_tab_mapping') || empty(g:ollama_original_tab_mapping)
             call ollama#logger#Info("Mapping <tab> to vim-ollama")
             let g:ollama_original_tab_mapping = maparg('<Tab>', 'i', 0, 1)
+            if get(g:ollama_original_tab_mapping, 'rhs', '') =~? '<Plug>(ollama-tab-completion)'
+                " the user mapped <Tab> to us already, this is no fallback
+                let g:ollama_original_tab_mapping = {}
+            endif
             call ollama#logger#Info("Original Mapping: " .. string(g:ollama_original_tab_mapping))
         else
             call ollama#logger#Info("Not mapping <tab> to vim-ollama, because mapping already exists")
@@ -233,6 +414,9 @@ endfunction
 function! s:Init() abort
     call ollama#setup#Init()
     call s:MapTab()
+    if g:ollama_warmup
+        call ollama#model#Warmup()
+    endif
     if g:ollama_debounce_time > 0
         augroup ollama_schedule
             autocmd CursorMovedI  * if &buftype != 'prompt' | call ollama#Schedule() | endif
@@ -246,6 +430,7 @@ augroup ollama
     autocmd!
     autocmd VimEnter              * call s:Init()
     autocmd BufDelete             * call ollama#review#BufDelete(expand("<abuf>"))
+    autocmd BufWritePost          * call ollama#project#FileWritten(expand("<afile>"))
     autocmd ColorScheme,VimEnter  * call s:ColorScheme()
 augroup END
 
@@ -270,9 +455,23 @@ command! -range=% OllamaReview <line1>,<line2>call ollama#review#Review()
 command! -range=% OllamaSpellCheck <line1>,<line2>call ollama#review#SpellCheck()
 command! -nargs=1 -range=% OllamaTask <line1>,<line2>call ollama#review#Task(<f-args>)
 command! -nargs=1 -range=% OllamaEdit <line1>,<line2>call ollama#edit#EditCode(<f-args>)
-command! OllamaChat call ollama#review#Chat()
+command! -nargs=? -range OllamaRefactor <line1>,<line2>call ollama#edit#Refactor(<q-args>)
+command! -nargs=* -complete=customlist,ollama#options#Complete OllamaChat call ollama#review#Chat(<f-args>)
+command! -nargs=* -complete=customlist,ollama#options#Complete OllamaChatRestore call ollama#review#Restore(<f-args>)
+command! -nargs=* -complete=customlist,ollama#options#Complete OllamaComplete call ollama#Complete(<f-args>)
+command! OllamaChats call ollama#review#ListSessions()
+command! -nargs=1 -complete=customlist,ollama#review#SessionComplete OllamaChatSwitch call ollama#review#SwitchSession(<f-args>)
+command! -range=% OllamaAttach call ollama#review#Attach(<line1>, <line2>)
+command! -range OllamaApply <line1>,<line2>call ollama#review#ApplyCodeBlock()
+command! OllamaExplain call ollama#review#Diagnostic(0)
+command! OllamaFix call ollama#review#Diagnostic(1)
 command! -nargs=1 -complete=customlist,ollama#CommandComplete Ollama call ollama#Command(<f-args>)
 command! -nargs=1 OllamaPull call ollama#setup#PullModel(g:ollama_host, <f-args>)
+command! -nargs=* -complete=customlist,ollama#model#Complete OllamaModel call ollama#model#Command(<f-args>)
+command! OllamaHealth call ollama#health#Check()
+command! -bang -nargs=? -complete=file OllamaDebugInfo call ollama#health#DebugInfo(<bang>0, <q-args>)
+command! -bang -nargs=? OllamaSystemPrompt call ollama#review#SystemPrompt(<bang>0, <q-args>)
+command! -nargs=? -complete=customlist,ollama#model#CompleteKind OllamaModels call ollama#model#Picker(<f-args>)
 
 " Define new signs for diffs
 sign define NewLine text=+ texthl=DiffAdd
@@ -0,0 +1,95 @@
+#!/usr/bin/env python3
+# SPDX-License-Identifier: GPL-3.0-or-later
+# SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
+#
+# This class stores chat transcripts in a JSON file, so that a conversation
+# can be restored later. The file may contain several sessions, because
+# multiple Vim instances can chat in the same project at the same time.
+# Every instance only updates its own session, and all writes are done
+# under a file lock using an atomic rename, so the file never gets corrupted.
+import os
+import json
+import time
+import uuid
+import tempfile
+
+try:
+    import fcntl
+except ImportError:
+    # no file locking on Windows
+    fcntl = None
+
+# max. number of sessions kept per file
+MAX_SESSIONS = 20
+
+
+class ChatHistory:
+    def __init__(self, filename):
+        self.filename = filename
+        self.session_id = uuid.uuid4().hex
+
+    def _lock(self):
+        """Returns a locked file object or None if locking is not available."""
+        if fcntl is None:
+            return None
+        lockfile = open(self.filename + ".lock", "w")
+        fcntl.flock(lockfile, fcntl.LOCK_EX)
+        return lockfile
+
+    def _unlock(self, lockfile):
+        if lockfile:
+            fcntl.flock(lockfile, fcntl.LOCK_UN)
+            lockfile.close()
+
+    def _read(self):
+        try:
+            with open(self.filename, "r", encoding="utf-8") as f:
+                data = json.load(f)
+            if isinstance(data.get("sessions"), dict):
+                return data
+        except (OSError, ValueError, AttributeError):
+            pass
+        return {"sessions": {}}
+
+    def load_latest(self):
+        """
+        Returns the messages of the most recent session and continues this
+        session, so that further messages get added to it.
+        """
+        lockfile = self._lock()
+        try:
+            sessions = self._read()["sessions"]
+        finally:
+            self._unlock(lockfile)
+        if not sessions:
+            return []
+        session_id, session = max(sessions.items(), key=lambda s: s[1].get("updated", 0))
+        self.session_id = session_id
+        return session.get("messages", [])
+
+    def save(self, messages):
+        """Stores the role-tagged messages of this session."""
+        messages = [m for m in messages if m.get("role") in ("user", "assistant")]
+        if not messages:
+            return
+        directory = os.path.dirname(self.filename) or "."
+        os.makedirs(directory, exist_ok=True)
+        lockfile = self._lock()
+        try:
+            data = self._read()
+            sessions = data["sessions"]
+            sessions[self.session_id] = {"updated": time.time(), "messages": messages}
+            # drop the oldest sessions
+            while len(sessions) > MAX_SESSIONS:
+                oldest = min(sessions, key=lambda s: sessions[s].get("updated", 0))
+                del sessions[oldest]
+            fd, tmpname = tempfile.mkstemp(dir=directory, prefix=".chat-", suffix=".tmp")
+            try:
+                with os.fdopen(fd, "w", encoding="utf-8") as f:
+                    json.dump(data, f, indent=2)
+                os.replace(tmpname, self.filename)
+            except Exception:
+                os.unlink(tmpname)
+                raise
+        finally:
+            self._unlock(lockfile)
@@ -3,12 +3,15 @@
 # SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
 import json
 import os
+import re
 import requests
 import threading
-from difflib import ndiff
+from difflib import ndiff, unified_diff
 from ChatTemplate import ChatTemplate
 from OllamaLogger import OllamaLogger
 from OllamaCredentials import OllamaCredentials
+from OllamaConnection import OllamaConnection
+from ReasoningFilter import ReasoningFilter
 
 # create logger
 log = None
@@ -47,6 +50,11 @@ g_original_content = []
 g_debug_mode = False  # You can turn this on/off as needed
 g_change_index = -1
 g_dialog_callback = None
+g_replace = False # replace the selection after confirmation instead of inline diff
+g_buffer = None # buffer of the edit
+# The editor runs inside of Vim, so the session keeps the connection to
+# the server alive between edits
+g_session = requests.Session()
 
 def CreateLogger():
     global log
@@ -78,6 +86,51 @@ def compute_diff(old_lines, new_lines):
     diff = list(ndiff(old_lines, new_lines))
     return diff
 
+def strip_code_fence(lines):
+    """
+    Removes a markdown code fence around the lines, LLMs often add one
+    even when asked not to do so.
+
+    Args:
+        lines (list): The lines of the LLM response.
+
+    Returns:
+        list: The lines without the opening and closing fence.
+    """
+    lines = list(lines)
+    if lines and lines[0].lstrip().startswith("```"):
+        lines.pop(0)
+    while lines and not lines[-1].strip():
+        lines.pop()
+    if lines and lines[-1].lstrip().startswith("```"):
+        lines.pop()
+    return lines
+
+def common_indent(lines):
+    """Returns the leading whitespace shared by all non-blank lines."""
+    indents = [line[:len(line) - len(line.lstrip())] for line in lines if line.strip()]
+    if not indents:
+        return ''
+    return os.path.commonprefix(indents)
+
+def reindent(old_lines, new_lines):
+    """
+    Restores the indentation of the original code when the LLM returns
+    the code with less indentation, e.g. a method body at column 0.
+
+    Args:
+        old_lines (list): The original lines.
+        new_lines (list): The changed lines.
+
+    Returns:
+        list: The changed lines with the original common indentation.
+    """
+    old_indent = common_indent(old_lines)
+    new_indent = common_indent(new_lines)
+    if len(new_indent) >= len(old_indent):
+        return new_lines
+    return [old_indent + line[len(new_indent):] if line.strip() else line for line in new_lines]
+
 def group_diff(diff, starting_line=1):
     """
     Group consecutive changes into chunks, excluding unchanged lines.
@@ -339,7 +392,7 @@ Please rewrite the code between the tags `<START_EDIT_HERE>` and `<STOP_EDIT_HER
     debug_print(prompt)
     return prompt
 
-def generate_code_completion(prompt, baseurl, model, options):
+def generate_code_completion(prompt, baseurl, model, options, connection=None):
     """
     Calls the Ollama REST API with the given prompt.
 
@@ -348,10 +401,13 @@ def generate_code_completion(prompt, baseurl, model, options):
         baseurl (str): The base URL of the Ollama server.
         model (str): The name of the model to use.
         options (dict): Additional options for the API call.
+        connection (OllamaConnection): TLS and authentication settings.
 
     Returns:
         str: The completion from the OpenAI API.
     """
+    if connection is None:
+        connection = OllamaConnection()
     headers = {
         'Content-Type': 'application/json',
         'Accept': '*/*',
@@ -375,7 +431,7 @@ def generate_code_completion(prompt, baseurl, model, options):
     }
     log.debug('request: ' + json.dumps(data, indent=4))
 
-    response = requests.post(endpoint, headers=headers, json=data)
+    response = connection.request('POST', endpoint, session=g_session, headers=headers, json=data)
 
     if response.status_code == 200:
         json_response = response.json()
@@ -439,17 +495,7 @@ def generate_code_completion_openai(prompt, baseurl='', model='', options=None,
     # OpenAI returns a list of choices
     completion = response.choices[0].message.content
     log.debug(completion)
-    # convert response to lines
-    lines = completion.splitlines()
-    if lines:
-        # remove 1st element from array if it starts with ```
-        if lines[0].startswith("```"):
-            lines.pop(0)
-        # remove last element from array if it starts with ```
-        if lines[-1].startswith("```"):
-            lines.pop()
-
-        completion = "\n".join(lines)
+    completion = "\n".join(strip_code_fence(completion.splitlines()))
     completion = completion.strip()
     log.debug(completion)
 
@@ -490,11 +536,17 @@ def edit_code(request, preamble, code, postamble, ft, settings, credentialname):
         if provider == "openai":
             response = generate_code_completion_openai(prompt, url, model, options, credentialname)
         else:
-            response = generate_code_completion(prompt, url, model, options)
+            connection = OllamaConnection(settings.get('ca_bundle'), bool(int(settings.get('insecure', 0))),
+                                          settings.get('auth'), settings.get('auth_keyname'),
+                                          float(settings.get('connect_timeout', 10)),
+                                          int(settings.get('retries', 2)))
+            response = generate_code_completion(prompt, url, model, options, connection)
 
     # check if we got a valid response
     if response is None or len(response) == 0:
         return []
+    # remove the reasoning of reasoning models
+    response = ReasoningFilter(settings.get('reasoning_delimiters')).strip(response)
 
     # split repsonse into lines
     lines = response.split('\n')
@@ -514,7 +566,7 @@ def edit_code(request, preamble, code, postamble, ft, settings, credentialname):
     lines = lines[:num_lines]
     if last_line:
         lines.append(last_line)
-    return lines
+    return strip_code_fence(lines)
 
 def vim_edit_code(request, firstline, lastline, settings, credentialname):
     """
@@ -562,6 +614,7 @@ def vim_edit_code(request, firstline, lastline, settings, credentialname):
 
         # Edit the code
         new_code_lines = edit_code(request, preamble, code, postamble, filetype, settings, credentialname)
+        new_code_lines = reindent(code_lines, new_code_lines)
 
         # Produce diff
         diff = compute_diff(code_lines, new_code_lines)
@@ -585,13 +638,22 @@ def vim_edit_code(request, firstline, lastline, settings, credentialname):
         g_result = result
         g_errormsg = errormsg
 
-def start_vim_edit_code(request, firstline, lastline, settings, credentialname):
+def start_vim_edit_code(request, firstline, lastline, settings, credentialname, replace=False):
+    """
+    Starts the edit in a worker thread.
+
+    Args:
+        replace (bool): When true the result is not applied by get_job_status(),
+                        but must be confirmed with ShowReplaceDialog().
+    """
     global log
     global g_editing_thread
     global g_result
     global g_errormsg
     global g_start_line
     global g_end_line
+    global g_replace
+    global g_buffer
 
     if log == None:
         CreateLogger()
@@ -601,6 +663,8 @@ def start_vim_edit_code(request, firstline, lastline, settings, credentialname):
     g_result = 'InProgress'
     g_start_line = int(firstline)
     g_end_line = int(lastline)
+    g_replace = replace
+    g_buffer = vim.current.buffer
     # Start the thread
     g_editing_thread = threading.Thread(target=vim_edit_code, args=(request, firstline, lastline, settings, credentialname))
     g_editing_thread.start()
@@ -641,7 +705,10 @@ def get_job_status():
 
         # Success:
         use_inline_diff = int(vim.eval('g:ollama_use_inline_diff'))
-        if use_inline_diff:
+        if g_replace:
+            # applied by ReplaceSelection() after confirmation
+            pass
+        elif use_inline_diff:
             apply_diff(g_diff, vim.current.buffer, g_start_line)
         else:
             apply_change(g_diff, vim.current.buffer, g_start_line)
@@ -665,6 +732,42 @@ def AcceptAllChanges():
 def RejectAllChanges():
     reject_changes(vim.current.buffer, g_original_content, g_start_line)
 
+def ShowReplaceDialog(dialog_callback):
+    """
+    Shows the diff of a refactoring in a popup and asks for confirmation.
+    The callback receives the result of popup_filter_yesno.
+    """
+    name = os.path.basename(g_buffer.name) if g_buffer.name else '[No Name]'
+    diff = list(unified_diff(g_original_content, g_new_code_lines,
+                             f"a/{name}", f"b/{name}", lineterm=''))
+    # use the real line numbers in the hunk headers
+    offset = g_start_line - 1
+    def hunk(match):
+        old, new = int(match.group(1)) + offset, int(match.group(3)) + offset
+        return f"@@ -{old}{match.group(2)} +{new}{match.group(4)} @@"
+    diff = [re.sub(r'^@@ -(\d+)(,\d+)? \+(\d+)(,\d+)? @@', hunk, line) for line in diff]
+    diff += ['', f"Replace lines {g_start_line}-{g_end_line}? y/n"]
+    vim.vars['ollama_refactor_diff'] = diff
+    winid = vim.eval(f'popup_dialog(g:ollama_refactor_diff, {{ "filter": "popup_filter_yesno", "callback": "{dialog_callback}", "padding": [0, 1, 0, 1], "maxheight": &lines - 4, "maxwidth": &columns - 4, "scrollbar": 1 }})')
+    vim.command('unlet g:ollama_refactor_diff')
+    vim.command(f'call win_execute({winid}, "setlocal syntax=diff")')
+
+def ReplaceSelection():
+    """
+    Replaces the edited lines with the new code. This is only one change,
+    so a single undo restores the original code.
+
+    Returns:
+        bool: False if the lines were modified while waiting for the LLM.
+    """
+    buf = g_buffer
+    start = g_start_line - 1
+    end = start + len(g_original_content)
+    if not buf.valid or list(buf[start:end]) != list(g_original_content):
+        return False
+    buf[start:end] = g_new_code_lines
+    return True
+
 def ShowAcceptDialog(dialog_callback, index):
     global g_groups, g_dialog_callback
     if not g_groups:
@@ -0,0 +1,146 @@
+#!/usr/bin/env python3
+# SPDX-License-Identifier: GPL-3.0-or-later
+# SPDX-CopyrightText: 2025 Gerhard Gappmeier <gappy1502@gmx.net>
+#
+# This class is used by the other Vim-Ollama python scripts
+# to connect to Ollama servers behind a reverse proxy with TLS
+# and authentication. HTTP(S)_PROXY and NO_PROXY are honored by
+# requests and httpx, so there is nothing to do for proxies.
+import base64
+import logging
+import os
+import re
+import ssl
+import time
+from typing import Optional
+from OllamaCredentials import OllamaCredentials
+
+DEFAULT_CONNECT_TIMEOUT = 10
+DEFAULT_RETRIES = 2
+# Initial and max. delay in seconds between retries
+RETRY_DELAY = 0.5
+MAX_RETRY_DELAY = 4
+# Server is busy (e.g. still loading a model) or a proxy could not reach it
+RETRY_STATUS_CODES = (502, 503, 504)
+
+class OllamaConnection:
+    def __init__(self, ca_bundle: Optional[str] = None, insecure: bool = False,
+                 auth: Optional[str] = None, credentialname: Optional[str] = None,
+                 connect_timeout: float = DEFAULT_CONNECT_TIMEOUT, retries: int = DEFAULT_RETRIES):
+        """
+        Args:
+            ca_bundle: Path of a CA bundle for verifying the server certificate.
+            insecure: Disables the certificate verification (explicit opt-in
+                      for self-signed certificates).
+            auth: 'bearer' or 'basic' to send an Authorization header.
+            credentialname: Credential name to lookup the token in password store.
+            connect_timeout: Timeout in seconds for connecting to the server.
+            retries: Number of retries for transient errors.
+        """
+        self.ca_bundle = os.path.expanduser(ca_bundle) if ca_bundle else None
+        self.insecure = insecure
+        self.auth = auth
+        self.credentialname = credentialname
+        self.connect_timeout = connect_timeout
+        self.retries = max(0, retries)
+        self._authorization = None
+
+    @staticmethod
+    def add_arguments(parser):
+        """Adds the connection options to an argparse parser."""
+        parser.add_argument('--ca-bundle', type=str, default=None,
+                            help="CA bundle for verifying the Ollama server certificate")
+        parser.add_argument('--insecure', action='store_true', default=False,
+                            help="Don't verify the Ollama server certificate")
+        parser.add_argument('--auth', type=str, default=None, choices=['bearer', 'basic'],
+                            help="Send an Authorization header to the Ollama server")
+        parser.add_argument('--auth-keyname', type=str, default=None,
+                            help="Credential name to lookup the Ollama token in password store")
+        parser.add_argument('--connect-timeout', type=float, default=DEFAULT_CONNECT_TIMEOUT,
+                            help="Timeout in seconds for connecting to the Ollama server")
+        parser.add_argument('--retries', type=int, default=DEFAULT_RETRIES,
+                            help="Number of retries on connection errors and busy servers")
+
+    @classmethod
+    def from_args(cls, args):
+        """Creates the connection from the options added by add_arguments()."""
+        return cls(args.ca_bundle, args.insecure, args.auth, args.auth_keyname,
+                   args.connect_timeout, args.retries)
+
+    def verify(self):
+        """Returns the 'verify' argument for requests."""
+        if self.insecure:
+            return False
+        return self.ca_bundle or True
+
+    def timeout(self):
+        """Returns the 'timeout' argument for requests. Generating can take
+        long, so only connecting is limited."""
+        return (self.connect_timeout, None)
+
+    def ssl_context(self):
+        """Returns the 'verify' argument for httpx."""
+        if self.insecure:
+            return False
+        if self.ca_bundle:
+            return ssl.create_default_context(cafile=self.ca_bundle)
+        return True
+
+    def headers(self, headers: Optional[dict] = None) -> dict:
+        """Returns a copy of the headers including the Authorization header."""
+        result = dict(headers or {})
+        if self.auth:
+            if self._authorization is None:
+                token = OllamaCredentials().GetOllamaToken(self.credentialname)
+                if self.auth == 'basic':
+                    # the token is given as 'user:password'
+                    token = base64.b64encode(token.encode('utf-8')).decode('ascii')
+                    self._authorization = f"Basic {token}"
+                else:
+                    self._authorization = f"Bearer {token}"
+            result['Authorization'] = self._authorization
+        return result
+
+    def request(self, method, url, session=None, **kwargs):
+        """
+        Sends a request using requests (or the given session) and retries
+        transient errors with exponential backoff: connection errors,
+        connect timeouts and the status codes 502, 503 and 504. Other
+        errors like 400 bad request are returned without retrying.
+        Only use this for idempotent requests.
+
+        Raises:
+            requests.ConnectionError with a concise message when all
+            retries failed.
+        """
+        import requests
+        client = session or requests
+        kwargs['headers'] = self.headers(kwargs.get('headers'))
+        kwargs.setdefault('verify', self.verify())
+        kwargs.setdefault('timeout', self.timeout())
+        log = logging.getLogger('OllamaLogger')
+        delay = RETRY_DELAY
+        for attempt in range(self.retries + 1):
+            last = attempt == self.retries
+            try:
+                response = client.request(method, url, **kwargs)
+                if response.status_code not in RETRY_STATUS_CODES or last:
+                    return response
+                reason = f"status {response.status_code}"
+            except (requests.ConnectionError, requests.Timeout) as e:
+                reason = self._reason(e)
+                if last:
+                    attempts = self.retries + 1
+                    raise requests.ConnectionError(
+                        f"Cannot connect to {url} ({reason}, {attempts} attempts)") from None
+            log.warning(f"{url}: {reason}, retrying in {delay}s")
+            time.sleep(delay)
+            delay = min(delay * 2, MAX_RETRY_DELAY)
+
+    @staticmethod
+    def _reason(error):
+        """Returns the root cause of a requests error, e.g. 'Connection refused'."""
+        match = re.search(r'\[Errno -?\d+\] ([^\'")]+)', str(error))
+        if match:
+            return match.group(1).strip()
+        return type(error).__name__
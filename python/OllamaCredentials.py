@@ -46,6 +46,35 @@ class OllamaCredentials:
             return key.strip()
 
         # 3. Try UNIX pass if available
+        password = self._PassShow(credentialname)
+        if password:
+            return password
+
+        # 4. No key found
+        raise EnvironmentError(f"Missing {env_var} environment variable and no credential found in pass.")
+
+    def GetOllamaToken(self, credentialname: Optional[str]) -> str:
+        """
+        Retrieve the token for an Ollama server behind an authenticating
+        reverse proxy. For basic authentication the token is 'user:password'.
+
+        Priority:
+          1. OLLAMA_API_KEY environment variable
+          2. UNIX pass (if credentialname is given and pass is available)
+          3. EnvironmentError if missing
+        """
+        key = os.getenv("OLLAMA_API_KEY")
+        if key:
+            return key.strip()
+
+        password = self._PassShow(credentialname)
+        if password:
+            return password
+
+        raise EnvironmentError("Missing OLLAMA_API_KEY environment variable and no credential found in pass.")
+
+    def _PassShow(self, credentialname: Optional[str]) -> Optional[str]:
+        """Returns the first line of the pass entry or None."""
         if credentialname and os.path.isfile("/usr/bin/pass") and os.access("/usr/bin/pass", os.X_OK):
             try:
                 pass_process = subprocess.Popen(
@@ -59,6 +88,4 @@ class OllamaCredentials:
                     return password
             except Exception as e:
                 print(f"Error retrieving password from password store: {e}")
-
-        # 4. No key found
-        raise EnvironmentError(f"Missing {env_var} environment variable and no credential found in pass.")
+        return None
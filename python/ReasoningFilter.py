@@ -0,0 +1,122 @@
+#!/usr/bin/env python3
+# SPDX-License-Identifier: GPL-3.0-or-later
+# SPDX-CopyrightText: 2025 Gerhard Gappmeier <gappy1502@gmx.net>
+#
+# Reasoning models like deepseek-r1 write their chain of thought in a
+# block like <think>...</think> before the answer. This class separates
+# these blocks from the answer, also for streamed responses where a
+# delimiter can be split across chunks.
+import argparse
+import json
+
+# Pairs of start and end delimiters of reasoning blocks
+DEFAULT_DELIMITERS = [['<think>', '</think>']]
+
+def delimiters_type(value):
+    """argparse type for a JSON list of [start, end] pairs."""
+    try:
+        delimiters = json.loads(value)
+    except json.JSONDecodeError as e:
+        raise argparse.ArgumentTypeError(f"invalid JSON: {e}")
+    if not isinstance(delimiters, list) or not all(
+            isinstance(d, list) and len(d) == 2 and all(isinstance(s, str) and s for s in d)
+            for d in delimiters):
+        raise argparse.ArgumentTypeError("expected a list of [start, end] pairs")
+    return delimiters
+
+class ReasoningFilter:
+    def __init__(self, delimiters=None):
+        """
+        Args:
+            delimiters: List of [start, end] pairs, None uses the default.
+                        An empty list disables the filter.
+        """
+        if delimiters is None:
+            delimiters = DEFAULT_DELIMITERS
+        self.delimiters = [tuple(d) for d in delimiters]
+        self._pending = ''
+        # end delimiter of the current reasoning block, None outside of blocks
+        self._end = None
+        # skip the newlines between a reasoning block and the answer
+        self._after_block = False
+
+    @staticmethod
+    def add_arguments(parser):
+        """Adds the delimiter option to an argparse parser."""
+        parser.add_argument('--reasoning-delimiters', type=delimiters_type, default=DEFAULT_DELIMITERS,
+                            help="JSON list of [start, end] delimiters of reasoning blocks to strip")
+
+    def feed(self, text):
+        """
+        Processes the next chunk of the response.
+
+        Returns:
+            list: (is_reasoning, text) tuples. The end of the chunk is kept
+            back if it could be the beginning of a delimiter.
+        """
+        self._pending += text
+        segments = []
+        while self._pending:
+            if self._end is None:
+                pos, start, end = self._find_start()
+                if pos == -1:
+                    keep = self._partial_len([d[0] for d in self.delimiters])
+                    self._emit(segments, False, self._pending[:len(self._pending) - keep])
+                    self._pending = self._pending[len(self._pending) - keep:]
+                    break
+                self._emit(segments, False, self._pending[:pos])
+                self._pending = self._pending[pos + len(start):]
+                self._end = end
+            else:
+                pos = self._pending.find(self._end)
+                if pos == -1:
+                    keep = self._partial_len([self._end])
+                    self._emit(segments, True, self._pending[:len(self._pending) - keep])
+                    self._pending = self._pending[len(self._pending) - keep:]
+                    break
+                self._emit(segments, True, self._pending[:pos])
+                self._pending = self._pending[pos + len(self._end):]
+                self._end = None
+                self._after_block = True
+        return segments
+
+    def flush(self):
+        """Returns the text kept back by feed() at the end of the response."""
+        segments = []
+        self._emit(segments, self._end is not None, self._pending)
+        self._pending = ''
+        self._end = None
+        self._after_block = False
+        return segments
+
+    def strip(self, text):
+        """Returns the text without reasoning blocks. An unterminated block
+        is removed up to the end, e.g. when the token limit was reached."""
+        segments = self.feed(text) + self.flush()
+        return ''.join(t for is_reasoning, t in segments if not is_reasoning)
+
+    def _find_start(self):
+        """Returns the position of the first start delimiter and the pair."""
+        best = (-1, None, None)
+        for start, end in self.delimiters:
+            pos = self._pending.find(start)
+            if pos != -1 and (best[0] == -1 or pos < best[0]):
+                best = (pos, start, end)
+        return best
+
+    def _partial_len(self, delimiters):
+        """Returns the length of the longest end of the pending text which
+        is the beginning of one of the delimiters."""
+        for n in range(min(len(self._pending), max((len(d) for d in delimiters), default=1) - 1), 0, -1):
+            tail = self._pending[-n:]
+            if any(d.startswith(tail) for d in delimiters):
+                return n
+        return 0
+
+    def _emit(self, segments, is_reasoning, text):
+        if not is_reasoning and self._after_block:
+            text = text.lstrip('\r\n')
+            if text:
+                self._after_block = False
+        if text:
+            segments.append((is_reasoning, text))
@@ -11,8 +11,12 @@ import httpx
 import json
 import asyncio
 import datetime
+import time
 from OllamaLogger import OllamaLogger
 from OllamaCredentials import OllamaCredentials
+from ChatHistory import ChatHistory
+from OllamaConnection import OllamaConnection
+from ReasoningFilter import ReasoningFilter, DEFAULT_DELIMITERS
 
 # Try to import OpenAI SDK
 try:
@@ -34,8 +38,139 @@ DEFAULT_TEMPERATURE = 0
 DEFAULT_MAX_TOKENS = 5000
 
 log = None
+# Marker which tells the Vim prompt buffer that the response is complete.
+# In interactive mode (terminal window) we show a prompt instead.
+end_of_text = "<EOT>"
+# Marker in front of an error message, which tells Vim that the response
+# failed
+error_marker = "<ERROR>"
+input_prompt = ""
+# Optional chat history of the project
+history = None
+# TLS and authentication settings of the Ollama server
+connection = OllamaConnection()
+# Show token and timing statistics after each response
+show_stats = False
+# Reasoning blocks of reasoning models: 'show', 'fold' or 'hide'.
+# They are printed between these markers, which Vim uses for folding.
+reasoning = "show"
+reasoning_delimiters = DEFAULT_DELIMITERS
+REASONING_START = "<think>"
+REASONING_END = "</think>"
+
+def get_error_message(response):
+    """Returns the error message of an Ollama error response."""
+    try:
+        return response.json().get("error", response.text)
+    except ValueError:
+        return response.text
+
+
+async def generate_chat_message_ollama(client, messages, endpoint, model, options):
+    """Non-streaming chat fallback using the Ollama generate API."""
+    endpoint = endpoint.rsplit("/api/chat", 1)[0] + "/api/generate"
+    system = ""
+    prompt = ""
+    for message in messages:
+        if message["role"] == "system":
+            system = message["content"]
+        else:
+            prompt += f"{message['role']}: {message['content']}\n\n"
+    prompt += "assistant: "
 
-async def stream_chat_message_ollama(messages, endpoint, model, options, timeout):
+    data = {
+        "model": model,
+        "prompt": prompt,
+        "system": system,
+        "stream": False,
+        "options": options,
+    }
+    log.debug("request: " + json.dumps(data, indent=4))
+    # the fallback needs the same authentication as the streaming request
+    response = await client.post(endpoint, headers=connection.headers({"Content-Type": "application/json"}), json=data)
+    if response.status_code != 200:
+        raise Exception(f"Error: {response.status_code} - {get_error_message(response)}")
+    return response.json().get("response", "")
+
+
+def print_error(message):
+    """Prints the error and ends the response."""
+    print(error_marker + message, flush=True)
+    print(end_of_text, flush=True)
+
+
+def format_stats(tokens, seconds, prompt_tokens, latency):
+    """
+    Returns the statistics line of a response, e.g.
+    '[42 tokens, 35.2 t/s, prompt 120 tokens, latency 0.81s]'
+    """
+    parts = []
+    if tokens is not None:
+        parts.append(f"{tokens} tokens")
+        if seconds:
+            parts.append(f"{tokens / seconds:.1f} t/s")
+    if prompt_tokens is not None:
+        parts.append(f"prompt {prompt_tokens} tokens")
+    if latency is not None:
+        parts.append(f"latency {latency:.2f}s")
+    return "[" + ", ".join(parts) + "]" if parts else ""
+
+
+def print_stats(line):
+    """Prints the statistics line. It is not part of the chat history."""
+    if show_stats and line:
+        print("\n" + line, flush=True)
+
+
+class ResponsePrinter:
+    """
+    Prints the streamed response. The reasoning is printed between
+    REASONING_START and REASONING_END lines, or hidden. Only the answer
+    is collected for the conversation history.
+    """
+    def __init__(self):
+        self.filter = ReasoningFilter(reasoning_delimiters)
+        self.answer = ""
+        self.in_reasoning = False
+
+    def feed(self, content, is_reasoning=False):
+        """Prints a chunk. is_reasoning is set for APIs which return
+        the reasoning separately."""
+        self._print([(True, content)] if is_reasoning else self.filter.feed(content))
+
+    def flush(self):
+        """Prints the rest at the end of the response."""
+        self._print(self.filter.flush())
+        self._end_reasoning("\n")
+
+    def _end_reasoning(self, separator):
+        if self.in_reasoning:
+            print("\n" + REASONING_END + separator, end="", flush=True)
+            self.in_reasoning = False
+
+    def _print(self, segments):
+        for is_reasoning, text in segments:
+            if is_reasoning:
+                if reasoning == "hide":
+                    continue
+                if not self.in_reasoning:
+                    print(REASONING_START + "\n", end="", flush=True)
+                    self.in_reasoning = True
+                    text = text.lstrip("\n")
+            else:
+                self._end_reasoning("\n\n")
+                self.answer += text
+            print(text, end="", flush=True)
+
+
+def create_client(timeout):
+    """Creates the HTTP client for Ollama. The client is shared by all
+    messages of the chat, so the connection to the server is kept alive."""
+    return httpx.AsyncClient(timeout=httpx.Timeout(timeout, connect=connection.connect_timeout),
+                             verify=connection.ssl_context())
+
+
+async def stream_chat_message_ollama(client, messages, endpoint, model, options):
     """Stream chat responses from Ollama API."""
     headers = {
         "Content-Type": "application/json",
@@ -51,43 +186,76 @@ async def stream_chat_message_ollama(messages, endpoint, model, options, timeout
     }
     log.debug("request: " + json.dumps(data, indent=4))
 
-    assistant_message = ""
+    printer = ResponsePrinter()
+    fallback = False
+    start = time.monotonic()
+    latency = None
 
     try:
-        async with httpx.AsyncClient(timeout=timeout) as client:
-            async with client.stream("POST", endpoint, headers=headers, json=data) as response:
-                if response.status_code == 200:
-                    async for line in response.aiter_lines():
-                        if line:
-                            message = json.loads(line)
-                            if "message" in message and "content" in message["message"]:
-                                content = message["message"]["content"]
-                                assistant_message += content
-                                print(content, end="", flush=True)
-
-                                # If <EOT> is detected, stop processing
-                                if "<EOT>" in content:
-                                    break
-                            # Stop if response contains an indication of completion
-                            if message.get("done", False):
-                                print("<EOT>", flush=True)
+        async with client.stream("POST", endpoint, headers=connection.headers(headers), json=data) as response:
+            if response.status_code == 200:
+                async for line in response.aiter_lines():
+                    if line:
+                        message = json.loads(line)
+                        # Ollama returns the reasoning separately if thinking is enabled
+                        thinking = message.get("message", {}).get("thinking")
+                        if thinking:
+                            if latency is None:
+                                latency = time.monotonic() - start
+                            printer.feed(thinking, is_reasoning=True)
+                        if "message" in message and "content" in message["message"]:
+                            content = message["message"]["content"]
+                            if latency is None and content:
+                                latency = time.monotonic() - start
+                            printer.feed(content)
+
+                            # If <EOT> is detected, stop processing
+                            if "<EOT>" in content:
+                                printer.flush()
                                 break
-                else:
-                    await response.aread()
-                    raise Exception(f"Error: {response.status_code} - {response.text}")
+                        # Stop if response contains an indication of completion
+                        if message.get("done", False):
+                            printer.flush()
+                            # durations are given in nanoseconds
+                            print_stats(format_stats(message.get("eval_count"),
+                                                     message.get("eval_duration", 0) / 1e9,
+                                                     message.get("prompt_eval_count"), latency))
+                            print(end_of_text, flush=True)
+                            break
+            elif response.status_code == 404:
+                # The streamed content must be read before accessing it
+                await response.aread()
+                error = get_error_message(response)
+                if "model" in error and "not found" in error:
+                    # the server knows /api/chat, but not the model
+                    raise Exception(f"Error: {error}")
+                fallback = True
+            else:
+                await response.aread()
+                raise Exception(f"Error: {response.status_code} - {response.text}")
+
+        if fallback:
+            # Old Ollama versions don't support the chat endpoint
+            print("The Ollama /api/chat endpoint was not found. "
+                  "Please update Ollama to v0.1.14 or newer. "
+                  "Falling back to /api/generate without streaming.\n", flush=True)
+            log.warning(f"{endpoint} not found, falling back to /api/generate")
+            printer.feed(await generate_chat_message_ollama(client, messages, endpoint, model, options))
+            printer.flush()
+            print(end_of_text, flush=True)
     except httpx.ReadTimeout:
-        print("Read timeout occurred. Please try again.")
+        print_error("Read timeout occurred. Please try again.")
         log.error("Read timeout occurred.")
     except asyncio.CancelledError:
         log.info("Task was cancelled.")
         raise
     except Exception as e:
-        print(f"An error occurred: {str(e)}")
+        print_error(f"An error occurred: {str(e)}")
         log.error(f"An error occurred: {str(e)}")
 
-    # Add the assistant's message to the conversation history
-    if assistant_message:
-        messages.append({"role": "assistant", "content": assistant_message.strip()})
+    # Add the assistant's message to the conversation history, without the reasoning
+    if printer.answer:
+        messages.append({"role": "assistant", "content": printer.answer.strip()})
 
 
 async def stream_chat_message_openai(messages, endpoint, model, options, credentialname):
@@ -107,12 +275,17 @@ async def stream_chat_message_openai(messages, endpoint, model, options, credent
     else:
         log.info('Using official OpenAI endpoint')
         client = AsyncOpenAI(api_key=api_key)
-    assistant_message = ""
+    printer = ResponsePrinter()
 
     temperature = options.get('temperature', DEFAULT_TEMPERATURE)
     max_tokens = options.get('max_tokens', DEFAULT_MAX_TOKENS)
     top_p = options.get('top_p', 1.0)
 
+    start = time.monotonic()
+    latency = None
+    usage = None
+    # the usage is only reported at the end of the stream if requested
+    extra = {"stream_options": {"include_usage": True}} if show_stats else {}
     try:
         stream = await client.chat.completions.create(
             model=model,
@@ -121,25 +294,76 @@ async def stream_chat_message_openai(messages, endpoint, model, options, credent
             max_tokens=max_tokens,
             top_p=top_p,
             stream=True,
+            **extra,
         )
 
         async for chunk in stream:
-            if chunk.choices and chunk.choices[0].delta and chunk.choices[0].delta.content:
-                token = chunk.choices[0].delta.content
-                assistant_message += token
-                print(token, end="", flush=True)
-
-        print("<EOT>", flush=True)
+            delta = chunk.choices[0].delta if chunk.choices else None
+            # some OpenAI compatible servers return the reasoning separately
+            thinking = getattr(delta, "reasoning_content", None) if delta else None
+            if thinking:
+                if latency is None:
+                    latency = time.monotonic() - start
+                printer.feed(thinking, is_reasoning=True)
+            if delta and delta.content:
+                token = delta.content
+                if latency is None:
+                    latency = time.monotonic() - start
+                printer.feed(token)
+            if getattr(chunk, "usage", None):
+                usage = chunk.usage
+        printer.flush()
+
+        if usage is not None:
+            # OpenAI doesn't report durations, so we measure the generation time
+            seconds = time.monotonic() - start - (latency or 0)
+            print_stats(format_stats(usage.completion_tokens, seconds, usage.prompt_tokens, latency))
+        print(end_of_text, flush=True)
 
     except Exception as e:
-        print(f"Error: {e}", file=sys.stderr)
+        print_error(f"Error: {e}")
         log.error(f"Error in OpenAI stream: {str(e)}")
 
-    if assistant_message:
-        messages.append({"role": "assistant", "content": assistant_message.strip()})
+    if printer.answer:
+        messages.append({"role": "assistant", "content": printer.answer.strip()})
+
+
+def save_history(messages):
+    if history is None:
+        return
+    try:
+        history.save(messages)
+    except Exception as e:
+        log.error(f"Failed to save chat history: {e}")
 
 
-async def main(provider, endpoint, model, options, systemprompt, timeout, credentialname):
+def restore_history(messages):
+    """Loads the last conversation and shows it as transcript."""
+    try:
+        restored = history.load_latest()
+    except Exception as e:
+        log.error(f"Failed to load chat history: {e}")
+        restored = []
+    if not restored:
+        print("No previous conversation found.")
+        print(end_of_text, flush=True)
+        return
+    for message in restored:
+        if message["role"] == "user":
+            print(">>> " + message["content"].replace("\n", "\n... "))
+        else:
+            print(message["content"] + "\n")
+        messages.append(message)
+    print(f"(restored {len(restored)} messages)")
+    print(end_of_text, flush=True)
+
+
+async def main(provider, endpoint, model, options, systemprompt, timeout, credentialname, restore):
+    async with create_client(timeout) as client:
+        await chat_loop(client, provider, endpoint, model, options, systemprompt, credentialname, restore)
+
+
+async def chat_loop(client, provider, endpoint, model, options, systemprompt, credentialname, restore):
     conversation_history = []
     log.debug("endpoint: " + str(endpoint))
 
@@ -149,12 +373,16 @@ async def main(provider, endpoint, model, options, systemprompt, timeout, creden
     if systemprompt:
         if provider == "ollama":
             # Let Ollama know the current date
-            systemprompt = f"Today's date is {datetime.date.today().isoformat()}"
+            systemprompt += f"\n\nToday's date is {datetime.date.today().isoformat()}."
         conversation_history.append({"role": "system", "content": systemprompt})
 
+    if restore and history is not None:
+        restore_history(conversation_history)
+
     while True:
         try:
-            user_message = input("").strip()
+            line = input("" if multiline_input else input_prompt)
+            user_message = line.strip()
 
             if multiline_input:
                 if user_message == '"""':
@@ -165,15 +393,17 @@ async def main(provider, endpoint, model, options, systemprompt, timeout, creden
 
                     if provider == "ollama":
                         task = asyncio.create_task(
-                            stream_chat_message_ollama(conversation_history, endpoint, model, options, timeout)
+                            stream_chat_message_ollama(client, conversation_history, endpoint, model, options)
                         )
                     else:
                         task = asyncio.create_task(
                             stream_chat_message_openai(conversation_history, endpoint, model, options, credentialname)
                         )
                     await task
+                    save_history(conversation_history)
                 else:
-                    multiline_message.append(user_message)
+                    # keep the indentation of code
+                    multiline_message.append(line.rstrip())
             else:
                 if user_message == '"""':
                     multiline_input = True
@@ -185,13 +415,14 @@ async def main(provider, endpoint, model, options, systemprompt, timeout, creden
                     conversation_history.append({"role": "user", "content": user_message})
                     if provider == "ollama":
                         task = asyncio.create_task(
-                            stream_chat_message_ollama(conversation_history, endpoint, model, options, timeout)
+                            stream_chat_message_ollama(client, conversation_history, endpoint, model, options)
                         )
                     else:
                         task = asyncio.create_task(
                             stream_chat_message_openai(conversation_history, endpoint, model, options, credentialname)
                         )
                     await task
+                    save_history(conversation_history)
 
         except KeyboardInterrupt:
             print("\nStreaming interrupted. Showing prompt again...")
@@ -220,10 +451,34 @@ if __name__ == "__main__":
     parser.add_argument("-d", "--log-dir", type=str, default="/tmp/logs", help="Log file directory.")
     parser.add_argument('-k', '--keyname', default=None,
                         help="Credential name to lookup API key and password store")
+    parser.add_argument("-i", "--interactive", action="store_true",
+                        help="Interactive mode for terminal windows (shows a prompt instead of <EOT> markers)")
+    parser.add_argument("-H", "--history-file", type=str, default=None,
+                        help="File for storing the chat history.")
+    parser.add_argument("-r", "--restore", action="store_true",
+                        help="Restore the last conversation from the history file.")
+    parser.add_argument("-S", "--stats", action="store_true",
+                        help="Show token and timing statistics after each response.")
+    parser.add_argument("--reasoning", type=str, default="show", choices=["show", "fold", "hide"],
+                        help="Show, fold or hide the reasoning of reasoning models.")
+    OllamaConnection.add_arguments(parser)
+    ReasoningFilter.add_arguments(parser)
     args = parser.parse_args()
 
     log = OllamaLogger(args.log_dir, args.log_filename)
     log.setLevel(args.log_level)
+    connection = OllamaConnection.from_args(args)
+
+    if args.interactive:
+        end_of_text = ""
+        error_marker = ""
+        input_prompt = ">>> "
+
+    if args.history_file:
+        history = ChatHistory(args.history_file)
+    show_stats = args.stats
+    reasoning = args.reasoning
+    reasoning_delimiters = args.reasoning_delimiters
 
     # Parse options JSON
     try:
@@ -240,10 +495,16 @@ if __name__ == "__main__":
         endpoint = args.url or DEFAULT_HOST
         endpoint = endpoint + "/api/chat"
 
+    if args.interactive:
+        title = f"Chat with '{model}' (via {args.provider})"
+        print(title)
+        print('-' * len(title))
+        print("(type 'quit' to exit, press CTRL-C to interrupt output)")
+
     try:
         while True:
             try:
-                asyncio.run(main(args.provider, endpoint, model, options, args.system_prompt, args.timeout, args.keyname))
+                asyncio.run(main(args.provider, endpoint, model, options, args.system_prompt, args.timeout, args.keyname, args.restore))
             except KeyboardInterrupt:
                 print("Canceled.")
                 break
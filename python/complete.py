@@ -12,6 +12,10 @@ import re
 from typing import Optional
 from OllamaLogger import OllamaLogger
 from OllamaCredentials import OllamaCredentials
+from OllamaConnection import OllamaConnection
+from load_model import keep_alive_type
+from ReasoningFilter import ReasoningFilter
+from model_info import fetch_model_info
 
 # try to load OpenAI package if it exists
 try:
@@ -33,12 +37,29 @@ DEFAULT_OPTIONS = '{ "temperature": 0, "top_p": 0.95 }'
 DEFAULT_MISTRAL_MODEL = 'codestral-2501'
 DEFAULT_OPENAI_MODEL = 'gpt-4.1-mini'
 DEFAULT_OPENAI_LEGACY_MODEL = 'gpt-3.5-turbo-instruct'
+# Context files: max. number of bytes read from other files
+DEFAULT_CONTEXT_BUDGET = 4096
+# Ollama's default context size and number of tokens to predict
+DEFAULT_NUM_CTX = 2048
+DEFAULT_MAX_NUM_CTX = 8192
+DEFAULT_NUM_PREDICT = 128
+# Rough estimate of characters per token, good enough for budgeting
+CHARS_PER_TOKEN = 4
+# Temperature used for additional candidates if the options don't enable
+# sampling, otherwise all candidates would be identical
+CANDIDATE_TEMPERATURE = 0.7
+# Exit code which tells Vim that the model is not installed
+EXIT_MODEL_NOT_FOUND = 3
+# Exit code which tells Vim that there is no FIM config for the model
+EXIT_NO_FIM_CONFIG = 4
 
 # When set to true, we use our own templates and don't use the Ollama built-in templates.
 # Is is the only way to make this work reliable. As soon is this works also with Ollama
 # REST API reliable we can get rid of our own templates.
 USE_CUSTOM_TEMPLATE = True
 log = None
+# TLS and authentication settings of the Ollama server
+connection = OllamaConnection()
 
 # Module-level constants for path and compiled regex
 _SCRIPT_DIR = os.path.dirname(os.path.abspath(__file__))
@@ -46,26 +67,50 @@ _CONFIG_DIR = os.path.join(_SCRIPT_DIR, "configs")
 _TRAILING_NUMBER_PATTERN = re.compile(r'[\d.]+$')
 
 
-def load_config(modelname):
+class ModelNotFoundError(Exception):
+    def __init__(self, model):
+        super().__init__(f"Model '{model}' not found")
+        self.model = model
+
+class NoFimConfigError(Exception):
+    def __init__(self, model):
+        super().__init__(f"No fill-in-the-middle config for model '{model}'. "
+                         f"Add '{model}.json' to g:ollama_fim_config_dir, "
+                         "see python/configs/README.md")
+        self.model = model
+
+def load_config(modelname, config_dirs=None):
+    """
+    Loads the FIM config of the model. The user config directories are
+    searched before the built-in configs, so they can override them and
+    add configs for unlisted models.
+    """
     # strip suffix (e.g ':7b-code') from modelname
     modelname = modelname.rsplit(':', 1)[0]
     modelname = modelname.split('/', 1)[-1]
 
     original_modelname = modelname
+    config_dirs = [os.path.expanduser(d) for d in (config_dirs or [])] + [_CONFIG_DIR]
 
     # Try exact match first, then progressively strip trailing parts
     current = modelname
     while True:
-        config_path = os.path.join(_CONFIG_DIR, f"{current}.json")
-        try:
-            with open(config_path, 'r') as file:
-                config = json.load(file)
-                return config
-        except FileNotFoundError:
-            pass
-        except json.JSONDecodeError:
-            log.error(f"Invalid JSON in config file: {config_path}")
-            sys.exit(1)
+        for config_dir in config_dirs:
+            config_path = os.path.join(config_dir, f"{current}.json")
+            try:
+                with open(config_path, 'r') as file:
+                    config = json.load(file)
+            except FileNotFoundError:
+                continue
+            except json.JSONDecodeError:
+                log.error(f"Invalid JSON in config file: {config_path}")
+                sys.exit(1)
+            missing = [key for key in ('pre', 'middle', 'suffix') if key not in config]
+            if missing:
+                log.error(f"Config file {config_path} misses {', '.join(missing)}")
+                sys.exit(1)
+            log.info(f"Using FIM config {config_path}")
+            return config
 
         # Strip trailing part: first by '-', then strip trailing digits
         if '-' in current:
@@ -76,8 +121,7 @@ def load_config(modelname):
             break
         current = next_current
 
-    log.error(f"Config file not found for {original_modelname}")
-    sys.exit(1)
+    raise NoFimConfigError(original_modelname)
 
 # config.json example:
 # {
@@ -106,8 +150,262 @@ def fill_in_the_middle(config, prompt):
 
     return newprompt
 
-def generate_code_completion(config, prompt, baseurl, model, options):
-    """ Code completion using Ollama REST API """
+def estimate_tokens(text):
+    """ Returns a rough estimate of the number of tokens of the given text. """
+    return (len(text) + CHARS_PER_TOKEN - 1) // CHARS_PER_TOKEN
+
+def load_context_files(filenames, budget):
+    """
+    Reads snippets of the given files until the byte budget is exhausted.
+    The files are expected to be ordered by relevance (most recently used first).
+    Returns a list of (filename, content) tuples.
+    """
+    snippets = []
+    for filename in filenames:
+        if budget <= 0:
+            break
+        try:
+            with open(filename, 'r', encoding='utf-8', errors='replace') as file:
+                content = file.read(budget)
+        except OSError as e:
+            log.warning(f"Cannot read context file {filename}: {e}")
+            continue
+        if len(content) == budget:
+            # file was truncated, cut at the last complete line
+            index = content.rfind('\n')
+            if index != -1:
+                content = content[:index + 1]
+        if not content.strip():
+            continue
+        snippets.append((filename, content))
+        budget -= len(content)
+    return snippets
+
+def add_context_files(prompt, snippets, options, num_ctx, reserved=0):
+    """
+    Prepends the context file snippets to the prompt. The snippets are
+    added in their order (most recently used first) while they fit into the
+    space the prompt leaves in the model's context window. Snippets which
+    don't fit are dropped as a whole. reserved is the number of tokens
+    needed for the template.
+    """
+    num_ctx = options.get('num_ctx', num_ctx)
+    num_predict = options.get('num_predict', DEFAULT_NUM_PREDICT)
+    available = num_ctx - num_predict - reserved - estimate_tokens(prompt)
+
+    blocks = []
+    for filename, content in snippets:
+        block = f"Path: {filename}\n{content}"
+        if not block.endswith('\n'):
+            block += '\n'
+        block += '\n'
+        tokens = estimate_tokens(block)
+        if tokens > available:
+            log.info(f"Dropping context file {filename}: exceeds num_ctx={num_ctx}")
+            continue
+        blocks.append(block)
+        available -= tokens
+
+    context = ''.join(blocks)
+    log.debug(f"Added {len(blocks)} context files ({estimate_tokens(context)} tokens)")
+    return context + prompt
+
+def trim_prompt(prompt, max_tokens):
+    """
+    Trims the prefix and suffix of the prompt symmetrically around the
+    cursor (<FILL_IN_HERE>) so that it fits into max_tokens. The code
+    nearest to the cursor is kept and only complete lines are removed,
+    so the model never sees a line cut in the middle.
+    """
+    parts = prompt.split('<FILL_IN_HERE>')
+    if len(parts) != 2 or estimate_tokens(prompt) <= max_tokens:
+        return prompt
+
+    prefix, suffix = parts
+    max_chars = max(0, max_tokens * CHARS_PER_TOKEN)
+    # each side gets half, a shorter side leaves its remainder to the other
+    half = max_chars // 2
+    prefix_len = min(len(prefix), max(half, max_chars - len(suffix)))
+    suffix_len = min(len(suffix), max_chars - prefix_len)
+    new_prefix = prefix[len(prefix) - prefix_len:]
+    new_suffix = suffix[:suffix_len]
+    # drop the partial lines at the cut, but keep the cursor line
+    if prefix_len < len(prefix) and '\n' in new_prefix:
+        new_prefix = new_prefix[new_prefix.index('\n') + 1:]
+    if suffix_len < len(suffix) and '\n' in new_suffix:
+        new_suffix = new_suffix[:new_suffix.rindex('\n') + 1]
+    log.info(f"Trimming prompt to {max_tokens} tokens: "
+             f"prefix {prefix.count(chr(10))} -> {new_prefix.count(chr(10))} lines, "
+             f"suffix {suffix.count(chr(10))} -> {new_suffix.count(chr(10))} lines")
+    return new_prefix + '<FILL_IN_HERE>' + new_suffix
+
+def remove_suffix_overlap(completion, suffix):
+    """
+    Removes the end of the completion which repeats the code after the
+    cursor, i.e. the rest of the cursor line or the following lines.
+    Models tend to do this when completing in the middle of a line, and
+    accepting such a completion would duplicate the code. Overlaps without
+    any word character, like a single ')', are ambiguous and kept.
+    Returns an empty string if the completion only repeats the suffix.
+    """
+    if not completion or not suffix:
+        return completion
+    text = completion.rstrip()
+    line_rest, _, following = suffix.partition('\n')
+    rest = line_rest.strip()
+    if rest:
+        # the overlap must start at a token boundary, e.g. '12' doesn't end with ' 2'
+        start = len(text) - len(rest)
+        boundary = start == 0 or not (text[start - 1].isalnum() and rest[0].isalnum())
+        if re.search(r'\w', rest) and text.endswith(rest) and boundary:
+            log.info(f"Removing the repeated rest of the line: {rest!r}")
+            return text[:start].rstrip(' \t')
+        return completion
+    # the cursor is at the end of the line, check the following lines
+    next_lines = [line.strip() for line in following.split('\n')]
+    while next_lines and not next_lines[0]:
+        next_lines.pop(0)
+    lines = text.split('\n')
+    for k in range(min(len(lines), len(next_lines)), 0, -1):
+        tail = [line.strip() for line in lines[-k:]]
+        if tail == next_lines[:k] and any(re.search(r'\w', line) for line in tail):
+            log.info(f"Removing {k} repeated lines after the cursor")
+            return '\n'.join(lines[:-k]).rstrip()
+    return completion
+
+def remove_reasoning(completion, delimiters):
+    """
+    Removes the reasoning blocks of reasoning models, e.g. <think>...</think>,
+    which must not end up in the buffer.
+    """
+    text = ReasoningFilter(delimiters).strip(completion)
+    if text != completion:
+        log.info("Removed the reasoning of the model from the completion")
+        return text.rstrip()
+    return completion
+
+def comment_prompt(prompt, comment, lang):
+    """
+    Returns the prompt for comment-to-code: instead of filling in the
+    middle, the model is asked to implement the comment before the cursor.
+    """
+    before, _, after = prompt.partition('<FILL_IN_HERE>')
+    lang = lang or 'the language of the code'
+    text = (f"Implement this comment in {lang}:\n{comment}\n\n"
+            f"The comment is at the end of the following code, "
+            f"your code gets inserted right after it:\n"
+            f"```\n{before.rstrip()}\n```\n")
+    if after.strip():
+        text += f"The code continues with:\n```\n{after.strip()}\n```\n"
+    text += ("Reply only with the new code. Don't repeat the comment or the existing code, "
+             "and don't add explanations.")
+    return text
+
+def format_comment_reply(reply, prompt):
+    """
+    Turns the reply to a comment_prompt() into a completion: removes a
+    markdown code fence and indents the code like the cursor line. The
+    first line is inserted at the cursor, so it gets no indentation.
+    """
+    lines = reply.strip('\n').split('\n')
+    if lines and lines[0].lstrip().startswith('```'):
+        lines.pop(0)
+    while lines and not lines[-1].strip():
+        lines.pop()
+    if lines and lines[-1].lstrip().startswith('```'):
+        lines.pop()
+    if not lines:
+        return ''
+    before = prompt.partition('<FILL_IN_HERE>')[0]
+    indent = before[before.rfind('\n') + 1:]
+    if indent.strip():
+        # not at the start of a line
+        indent = ''
+    common = os.path.commonprefix([l[:len(l) - len(l.lstrip())] for l in lines if l.strip()])
+    lines = [l[len(common):] for l in lines]
+    return '\n'.join([lines[0]] + [indent + l if l.strip() else l for l in lines[1:]])
+
+def template_tokens(config):
+    """ Returns the estimated number of tokens added by the FIM template. """
+    if not config:
+        return 0
+    return sum(estimate_tokens(config.get(key, '')) for key in ('pre', 'middle', 'suffix'))
+
+def compute_num_ctx(prompt, options, max_num_ctx):
+    """
+    Computes the context window size needed for the prompt and the tokens
+    to predict. The result is rounded up to the next power of two and
+    limited to max_num_ctx. Each new size makes Ollama reload the model,
+    the powers of two keep the number of sizes small.
+    """
+    required = estimate_tokens(prompt) + options.get('num_predict', DEFAULT_NUM_PREDICT)
+    num_ctx = DEFAULT_NUM_CTX
+    while num_ctx < required and num_ctx < max_num_ctx:
+        num_ctx *= 2
+    return min(num_ctx, max_num_ctx)
+
+def get_model_info(baseurl, model, info=None):
+    """
+    Returns the model info given by Vim (see model_info.py). Without it,
+    the info is requested from Ollama. Returns an empty dict if this
+    fails, then the FIM fallback and the context size work without it.
+    """
+    if info is not None:
+        return info
+    try:
+        info = fetch_model_info(baseurl, model, connection)
+    except Exception as e:
+        log.warning(f"Cannot get the model info of {model}: {e}")
+        return {}
+    if info is None:
+        raise ModelNotFoundError(model)
+    return info
+
+def model_supports_suffix(info):
+    """
+    Returns True if the Ollama template of the model uses the suffix
+    ('.Suffix'), i.e. Ollama can do fill-in-the-middle for this model.
+    """
+    return info.get('suffix', False)
+
+def context_limit(info, options, max_num_ctx):
+    """
+    Returns the context window size the prompt must fit into, and whether
+    it is fixed. It is fixed if num_ctx is given in the options or in the
+    Modelfile, otherwise it is the upper bound for compute_num_ctx(),
+    limited to what the model supports.
+    """
+    if 'num_ctx' in options:
+        return options['num_ctx'], True
+    if info.get('num_ctx'):
+        log.debug(f"Using num_ctx={info['num_ctx']} of the Modelfile")
+        return info['num_ctx'], True
+    model_max = info.get('context_length')
+    if model_max and model_max < max_num_ctx:
+        log.debug(f"The model supports only {model_max} tokens of context")
+        return model_max, False
+    return max_num_ctx, False
+
+def prefix_only_prompt(prompt, suffix_hint):
+    """
+    Creates a plain completion prompt for models without FIM support.
+    The code after the cursor is dropped, or added in front of the code
+    as hint if suffix_hint is set.
+    """
+    prefix, _, suffix = prompt.partition('<FILL_IN_HERE>')
+    if suffix_hint and suffix.strip():
+        return f"Code after the cursor:\n{suffix}\n\nCode before the cursor:\n{prefix}"
+    return prefix
+
+def generate_code_completion(config, prompt, baseurl, model, options, fim=True, suffix_hint=False,
+                             keep_alive=None):
+    """
+    Code completion using Ollama REST API. Uses the FIM config if given,
+    otherwise Ollama's built-in template with the suffix argument. Models
+    without FIM support (fim=False) get a plain completion of the prefix.
+    keep_alive defines how long the model stays loaded, None uses the
+    server default.
+    """
     headers = {
         'Content-Type': 'application/json',
         'Accept': '*/*',
@@ -116,7 +414,7 @@ def generate_code_completion(config, prompt, baseurl, model, options):
     endpoint = baseurl + "/api/generate"
     log.debug('endpoint: ' + endpoint)
 
-    if USE_CUSTOM_TEMPLATE:
+    if config is not None:
         log.info('Using custom prompt in raw mode')
         # generate model specific prompt using our templates
         prompt = fill_in_the_middle(config, prompt)
@@ -128,6 +426,15 @@ def generate_code_completion(config, prompt, baseurl, model, options):
             'raw' : True,
             'options': options
         }
+    elif not fim:
+        log.info('Model has no FIM support, completing the prefix only')
+        data = {
+            'model': model,
+            'prompt': prefix_only_prompt(prompt, suffix_hint),
+            'stream': False,
+            'raw' : True,
+            'options': options
+        }
     else:
         log.info("Using Ollama's built-in templates and suffix argument.")
         # Use Ollama code completion API using built-in templates.
@@ -149,9 +456,11 @@ def generate_code_completion(config, prompt, baseurl, model, options):
             'raw' : False,
             'options': options
         }
+    if keep_alive is not None:
+        data['keep_alive'] = keep_alive
     log.debug('request: ' + json.dumps(data, indent=4))
 
-    response = requests.post(endpoint, headers=headers, json=data)
+    response = connection.request('POST', endpoint, headers=headers, json=data)
 
     if response.status_code == 200:
         json_response = response.json()
@@ -168,6 +477,43 @@ def generate_code_completion(config, prompt, baseurl, model, options):
             pass
 
         return completion.rstrip()
+    elif response.status_code in (404, 500) and 'not found' in response.text:
+        raise ModelNotFoundError(model)
+    else:
+        raise Exception(f"Error: {response.status_code} - {response.text}")
+
+def generate_comment_completion(prompt, baseurl, model, options, keep_alive=None):
+    """
+    Comment-to-code using Ollama REST API with the built-in template of the
+    model. The prompt is created by comment_prompt(), so this needs an
+    instruction model.
+    """
+    headers = {
+        'Content-Type': 'application/json',
+        'Accept': '*/*',
+        'Host': baseurl.split('//')[1].split('/')[0]
+    }
+    endpoint = baseurl + "/api/generate"
+    log.info('Using comment-to-code prompt')
+    data = {
+        'model': model,
+        'prompt': prompt,
+        'system': "You are a code completion engine. You reply with code only.",
+        'stream': False,
+        'options': options
+    }
+    if keep_alive is not None:
+        data['keep_alive'] = keep_alive
+    log.debug('request: ' + json.dumps(data, indent=4))
+
+    response = connection.request('POST', endpoint, headers=headers, json=data)
+
+    if response.status_code == 200:
+        completion = response.json().get('response', '')
+        log.info('completion:' + completion)
+        return completion
+    elif response.status_code in (404, 500) and 'not found' in response.text:
+        raise ModelNotFoundError(model)
     else:
         raise Exception(f"Error: {response.status_code} - {response.text}")
 
@@ -215,7 +561,8 @@ def generate_code_completion_mistral(prompt, baseurl, model, options, credential
             temperature=temperature,
     #        min_tokens=min_tokens,
             max_tokens=max_tokens,
-            stop=stops
+            stop=stops,
+            **seed_kwargs(options, 'random_seed')
         )
         response = response.choices[0].message.content
         log.debug('response: ' + response)
@@ -235,8 +582,9 @@ def extract_stop_marker(after: str) -> Optional[str]:
             return line.rstrip()  # preserve indentation
     return None
 
-def generate_code_completion_openai(prompt, baseurl, model, options, credentialname):
-    """Generate code completion using OpenAI's official Python SDK"""
+def generate_code_completion_openai(prompt, baseurl, model, options, credentialname, comment=None):
+    """Generate code completion using OpenAI's official Python SDK. With a
+    comment the model implements the comment instead of filling in the middle."""
     if OpenAI is None:
         raise ImportError("OpenAI package not found. Please install via 'pip install openai'.")
 
@@ -277,6 +625,8 @@ BEFORE:
 AFTER:
 {after}
 """
+    if comment:
+        full_prompt = comment_prompt(prompt, comment, lang)
     log.debug('full_prompt: ' + full_prompt)
 
     stop_marker = extract_stop_marker(after)
@@ -295,9 +645,12 @@ AFTER:
             messages=[{"role": "user", "content": full_prompt}],
             temperature=temperature,
             max_tokens=max_tokens,
-            stop=stops
+            stop=stops,
+            **seed_kwargs(options)
         )
-        response = response.choices[0].message.content.strip()
+        response = response.choices[0].message.content
+        # the indentation is needed for indenting the implemented comment
+        response = response.strip('\n') if comment else response.strip()
         log.debug('response: ' + response)
     except Exception as e:
         # Print only the root cause message, not the full traceback
@@ -354,13 +707,50 @@ def generate_code_completion_openai_legacy(prompt, baseurl, model, options, cred
         model=model,
         prompt=full_prompt,
         temperature=temperature,
-        max_tokens=max_tokens
+        max_tokens=max_tokens,
+        **seed_kwargs(options)
     )
     response = response.choices[0].text
     log.debug('response: ' + response)
 
     return response.rstrip()
 
+def seed_kwargs(options, name='seed'):
+    """
+    Returns the seed option as keyword argument for the OpenAI and Mistral
+    clients, which don't take it from the options like Ollama does.
+    """
+    if 'seed' not in options:
+        return {}
+    return {name: options['seed']}
+
+def generate_candidates(generate, options, count):
+    """
+    Calls generate(options) count times and returns the distinct non-empty
+    completions. The first candidate uses the given options, the others
+    enable sampling to get different results. If an additional request
+    fails we return what we have so far.
+    """
+    candidates = []
+    for i in range(count):
+        opts = dict(options)
+        if i > 0:
+            if not opts.get('temperature'):
+                opts['temperature'] = CANDIDATE_TEMPERATURE
+            if 'seed' in opts:
+                opts['seed'] = opts['seed'] + i
+        try:
+            completion = generate(opts)
+        except Exception as e:
+            if i == 0:
+                raise
+            log.warning(f"Candidate {i + 1} failed: {e}")
+            break
+        if completion.strip() and completion not in candidates:
+            candidates.append(completion)
+    log.info(f"{len(candidates)} distinct candidates of {count}")
+    return candidates
+
 if __name__ == "__main__":
     try:
         parser = argparse.ArgumentParser(description="Complete code using Ollama or OpenAI LLM.")
@@ -382,19 +772,53 @@ if __name__ == "__main__":
                             help="Use Ollama code generation suffix (experimental)")
         parser.add_argument('-k', '--keyname', default=None,
                             help="Credential name to lookup API key and password store")
+        parser.add_argument('-c', '--context-file', action='append', default=[],
+                            help="Add file as completion context (can be used multiple times)")
+        parser.add_argument('-b', '--context-budget', type=int, default=DEFAULT_CONTEXT_BUDGET,
+                            help="Max. number of bytes to read from context files")
+        parser.add_argument('-x', '--max-num-ctx', type=int, default=DEFAULT_MAX_NUM_CTX,
+                            help="Upper bound for the automatically computed num_ctx (Ollama only)")
+        parser.add_argument('-n', '--candidates', type=int, default=1,
+                            help="Number of completion candidates, more than one prints a JSON array")
+        parser.add_argument('-C', '--config-dir', action='append', default=[],
+                            help="Directory with user FIM configs, searched before the built-in configs")
+        parser.add_argument('-F', '--no-fim-fallback', action='store_true', default=False,
+                            help="Fail if there is no FIM config instead of falling back to Ollama's template")
+        parser.add_argument('-S', '--suffix-hint', action='store_true', default=False,
+                            help="Add the suffix as hint for models without FIM support")
+        parser.add_argument('-K', '--keep-alive', type=keep_alive_type, default=None,
+                            help="How long Ollama keeps the model loaded, in seconds or like '30m'")
+        parser.add_argument('-I', '--comment', type=str, default=None,
+                            help="Comment before the cursor, which the model implements instead of filling in the middle")
+        parser.add_argument('-M', '--model-info', type=json.loads, default=None,
+                            help="Model info as printed by model_info.py, otherwise it is requested from Ollama")
+        OllamaConnection.add_arguments(parser)
+        ReasoningFilter.add_arguments(parser)
         args = parser.parse_args()
 
         log = OllamaLogger(args.log_dir, args.log_filename)
         log.setLevel(args.log_level)
         USE_CUSTOM_TEMPLATE = args.T
+        connection = OllamaConnection.from_args(args)
 
         # parse options JSON string
         try:
             options = json.loads(args.options)
         except json.JSONDecodeError:
             options = json.loads(DEFAULT_OPTIONS)
+        if 'seed' in options:
+            log.info(f"Using seed {options['seed']}, temperature {options.get('temperature')}")
+            if args.provider != 'ollama':
+                # Ollama makes the result reproducible, other servers may ignore the seed
+                log.warning(f"Seeding is best effort with provider {args.provider}")
 
         prompt = sys.stdin.read()
+        # the code after the cursor, for removing repetitions of it
+        suffix = prompt.partition('<FILL_IN_HERE>')[2]
+
+        snippets = []
+        if args.context_file:
+            snippets = load_context_files(args.context_file, args.context_budget)
 
         if args.provider == "ollama":
             if args.model:
@@ -402,35 +826,93 @@ if __name__ == "__main__":
             else:
                 modelname = DEFAULT_MODEL
             baseurl = args.url or DEFAULT_HOST
-            config = load_config(modelname) if USE_CUSTOM_TEMPLATE else None
-            response = generate_code_completion(config, prompt, baseurl, modelname, options)
+            config = None
+            fim = True
+            info = get_model_info(baseurl, modelname, args.model_info)
+            if USE_CUSTOM_TEMPLATE:
+                try:
+                    config = load_config(modelname, args.config_dir)
+                except NoFimConfigError:
+                    if args.no_fim_fallback:
+                        raise
+                    # fall back to Ollama's template, if it supports FIM
+                    fim = model_supports_suffix(info)
+                    if not fim:
+                        usage = "only used as hint" if args.suffix_hint else "ignored"
+                        print(f"Warning: Model '{modelname}' does not support fill-in-the-middle, "
+                              f"the code after the cursor is {usage}.", file=sys.stderr)
+            num_ctx, fixed = context_limit(info, options, args.max_num_ctx)
+            # the tokens to predict and the template must fit as well
+            num_predict = options.get('num_predict', DEFAULT_NUM_PREDICT)
+            # the code around the cursor is more important than other files,
+            # so the context files only get the space it leaves
+            prompt = trim_prompt(prompt, num_ctx - num_predict - template_tokens(config))
+            if snippets:
+                prompt = add_context_files(prompt, snippets, options, num_ctx, template_tokens(config))
+            if not fixed:
+                # size the context window based on the prompt
+                options['num_ctx'] = compute_num_ctx(prompt, options, num_ctx)
+            log.info(f"num_ctx: {options.get('num_ctx', num_ctx)}")
+            if args.comment:
+                instruction = comment_prompt(prompt, args.comment, options.get('lang'))
+                generate = lambda opts: generate_comment_completion(instruction, baseurl, modelname, opts,
+                                                                    args.keep_alive)
+            else:
+                generate = lambda opts: generate_code_completion(config, prompt, baseurl, modelname, opts,
+                                                                 fim, args.suffix_hint, args.keep_alive)
         elif args.provider == "mistral":
             if args.model:
                 modelname = args.model
             else:
                 modelname = DEFAULT_MISTRAL_MODEL
             baseurl = args.url or None
-            response = generate_code_completion_mistral(prompt, baseurl, modelname, options, args.keyname)
+            generate = lambda opts: generate_code_completion_mistral(prompt, baseurl, modelname, opts, args.keyname)
         elif args.provider == "openai":
             if args.model:
                 modelname = args.model
             else:
                 modelname = DEFAULT_OPENAI_MODEL
             baseurl = args.url or None
-            response = generate_code_completion_openai(prompt, baseurl, modelname, options, args.keyname)
+            generate = lambda opts: generate_code_completion_openai(prompt, baseurl, modelname, opts, args.keyname,
+                                                                    args.comment)
         elif args.provider == "openai_legacy":
             if args.model:
                 modelname = args.model
             else:
                 modelname = DEFAULT_OPENAI_LEGACY_MODEL
             baseurl = args.url or None
-            response = generate_code_completion_openai_legacy(prompt, baseurl, modelname, options, args.keyname)
+            generate = lambda opts: generate_code_completion_openai_legacy(prompt, baseurl, modelname, opts, args.keyname)
         else:
             log.error(f"Unknown provider: {args.provider}")
             sys.exit(1)
 
-        print(response, end='')
+        if snippets and args.provider != "ollama":
+            prompt = add_context_files(prompt, snippets, options, args.max_num_ctx)
+
+        if args.comment and args.provider not in ('ollama', 'openai'):
+            log.info(f"Provider {args.provider} has no comment-to-code prompt, using fill-in-the-middle")
+            args.comment = None
+
+        generate_raw = generate
+        generate_reply = lambda opts: remove_reasoning(generate_raw(opts), args.reasoning_delimiters)
+        if args.comment:
+            generate_code = generate_reply
+            generate_reply = lambda opts: format_comment_reply(generate_code(opts), prompt)
+        generate = lambda opts: remove_suffix_overlap(generate_reply(opts), suffix)
+        if args.candidates > 1:
+            # multiple candidates are returned as JSON array
+            print(json.dumps(generate_candidates(generate, options, args.candidates)), end='')
+        else:
+            print(generate(options), end='')
 
+    except ModelNotFoundError as e:
+        print(f"Error: {e}", file=sys.stderr)
+        log.error(str(e))
+        sys.exit(EXIT_MODEL_NOT_FOUND)
+    except NoFimConfigError as e:
+        # Vim shows the message, so don't print it to stderr
+        log.warning(str(e))
+        sys.exit(EXIT_NO_FIM_CONFIG)
     except KeyboardInterrupt:
         # Allow Ctrl+C without traceback
         print("Error: Aborted by user", file=sys.stderr)
@@ -7,17 +7,27 @@ import os
 import sys
 from OllamaLogger import OllamaLogger
 from OllamaCredentials import OllamaCredentials
+from OllamaConnection import OllamaConnection
 
 DEFAULT_OLLAMA_URL = "http://localhost:11434"
 DEFAULT_PROVIDER = "ollama"
 log = None
+connection = OllamaConnection()
 
-def list_ollama_models(base_url):
+def format_size(size):
+    """Formats a size in bytes as human readable string."""
+    for unit in ["B", "KB", "MB", "GB"]:
+        if size < 1000:
+            return f"{size:.0f} {unit}" if unit == "B" else f"{size:.1f} {unit}"
+        size /= 1000
+    return f"{size:.1f} TB"
+
+def list_ollama_models(base_url, verbose=False):
     """List models installed in a local Ollama server."""
     url = f"{base_url}/api/tags"
     try:
         log.debug(f'url={url}')
-        response = requests.get(url)
+        response = connection.request('GET', url)
         if response.status_code != 200:
             print(f"Failed to retrieve models (status {response.status_code})", file=sys.stderr)
             sys.exit(1)
@@ -28,7 +38,15 @@ def list_ollama_models(base_url):
             print("No models found.", file=sys.stderr)
             return
         for model in models:
-            print(model["name"])
+            if verbose:
+                # tab separated: name, size, family, parameter size
+                details = model.get("details", {})
+                print("\t".join([model["name"],
+                                 format_size(model.get("size", 0)),
+                                 details.get("family", ""),
+                                 details.get("parameter_size", "")]))
+            else:
+                print(model["name"])
     except requests.exceptions.RequestException as e:
         print(f"Error contacting Ollama: {e}", file=sys.stderr)
         sys.exit(1)
@@ -67,7 +85,7 @@ def list_openai_models(base_url, credentialname):
         sys.exit(1)
 
 def main():
-    global log
+    global log, connection
     # Set up argument parsing
     parser = argparse.ArgumentParser(description="List models from Ollama or OpenAI")
     parser.add_argument("-p", "--provider", type=str, default=DEFAULT_PROVIDER,
@@ -83,16 +101,20 @@ def main():
                         help="Specify log file directory")
     parser.add_argument('-k', '--keyname', default=None,
                         help="Credential name to lookup API key and password store")
+    parser.add_argument('-v', '--verbose', action='store_true',
+                        help="Show size and family of Ollama models (tab separated)")
+    OllamaConnection.add_arguments(parser)
     # Parse arguments
     args = parser.parse_args()
 
     log = OllamaLogger(args.log_dir, args.log_filename)
     log.setLevel(args.log_level)
+    connection = OllamaConnection.from_args(args)
 
     if args.provider == "ollama":
         if args.url == None:
             args.url = DEFAULT_OLLAMA_URL
-        list_ollama_models(args.url)
+        list_ollama_models(args.url, args.verbose)
     elif args.provider == "openai" or args.provider == "openai_legacy" or args.provider == "mistral":
         list_openai_models(args.url, args.keyname)
     else:
@@ -3,19 +3,21 @@
 # SPDX-CopyrightText: 2024 Gerhard Gappmeier <gappy1502@gmx.net>
 import requests
 import argparse
+from OllamaConnection import OllamaConnection
 
 # We can load a model using an empy prompt
-def load_ollama_model(base_url, model_name, keep_alive):
+def load_ollama_model(base_url, model_name, keep_alive, connection):
     url = f"{base_url}/api/generate"
 
     # Data to be sent in the POST request
     data = {
         "model": model_name,
-        "keep_alive": keep_alive
     }
+    if keep_alive is not None:
+        data["keep_alive"] = keep_alive
     try:
         # Make a POST request to load the model
-        response = requests.post(url, json = data)
+        response = connection.request('POST', url, json = data)
 
         # Check if the response status code is 200 (OK)
         if response.status_code == 200:
@@ -30,18 +32,27 @@ def load_ollama_model(base_url, model_name, keep_alive):
         print(f"Error occurred while making the request: {e}")
         exit(1)
 
+def keep_alive_type(value):
+    """Ollama accepts seconds as number or durations like '30m'"""
+    try:
+        return int(value)
+    except ValueError:
+        return value
+
 def main():
     # Set up argument parsing
     parser = argparse.ArgumentParser(description="Load Ollama model")
     parser.add_argument('-u', '--url', type=str, default="http://localhost:11434", help="Base URL of the Ollama API")
     parser.add_argument('-m', '--model', type=str, required=True, help="Model name")
-    parser.add_argument('-k', '--keep-alive', type=int, default=300, help="Keep alive interval in seconds (0 unloads the model)")
+    parser.add_argument('-k', '--keep-alive', type=keep_alive_type, default=None,
+                        help="Keep alive in seconds or as duration like '30m' (0 unloads the model, -1 keeps it loaded)")
+    OllamaConnection.add_arguments(parser)
 
     # Parse arguments
     args = parser.parse_args()
 
     # Call the function with the provided base URL
-    load_ollama_model(args.url, args.model, args.keep_alive)
+    load_ollama_model(args.url, args.model, args.keep_alive, OllamaConnection.from_args(args))
 
 if __name__ == "__main__":
     main()
@@ -0,0 +1,79 @@
+#!/usr/bin/env python3
+# SPDX-License-Identifier: GPL-3.0-or-later
+# SPDX-CopyrightText: 2025 Gerhard Gappmeier <gappy1502@gmx.net>
+#
+# Looks up the details of an Ollama model which complete.py needs: the
+# FIM support of its template and its context sizes. Vim runs this once
+# per model and passes the result to complete.py, so the completions
+# don't need an extra request.
+import argparse
+import json
+import sys
+from OllamaConnection import OllamaConnection
+
+# Exit code which tells Vim that the model is not installed
+EXIT_MODEL_NOT_FOUND = 3
+
+
+def parse_model_info(details):
+    """
+    Extracts the model info from the /api/show response:
+      - 'suffix': True if the template uses the suffix ('.Suffix'), i.e.
+        Ollama can do fill-in-the-middle for this model
+      - 'context_length': max. context length supported by the model, or None
+      - 'num_ctx': num_ctx parameter of the Modelfile, or None
+    """
+    context_length = None
+    for key, value in details.get('model_info', {}).items():
+        if key.endswith('.context_length') and isinstance(value, int):
+            context_length = value
+            break
+    num_ctx = None
+    for line in details.get('parameters', '').splitlines():
+        name, _, value = line.strip().partition(' ')
+        if name == 'num_ctx':
+            try:
+                num_ctx = int(value)
+            except ValueError:
+                pass
+            break
+    return {
+        'suffix': '.Suffix' in details.get('template', ''),
+        'context_length': context_length,
+        'num_ctx': num_ctx,
+    }
+
+
+def fetch_model_info(baseurl, model, connection):
+    """
+    Returns the model info (see parse_model_info()), or None if the model
+    is not installed.
+    """
+    response = connection.request('POST', baseurl + "/api/show", json={'model': model})
+    if response.status_code == 404:
+        return None
+    if response.status_code != 200:
+        raise Exception(f"Error: {response.status_code} - {response.text}")
+    return parse_model_info(response.json())
+
+
+def main():
+    parser = argparse.ArgumentParser(description="Print the model info needed by complete.py as JSON")
+    parser.add_argument('-u', '--url', type=str, default="http://localhost:11434", help="Base URL of the Ollama API")
+    parser.add_argument('-m', '--model', type=str, required=True, help="Model name")
+    OllamaConnection.add_arguments(parser)
+    args = parser.parse_args()
+
+    try:
+        info = fetch_model_info(args.url, args.model, OllamaConnection.from_args(args))
+    except Exception as e:
+        print(f"Error: {e}", file=sys.stderr)
+        sys.exit(1)
+    if info is None:
+        print(f"Error: Model '{args.model}' not found", file=sys.stderr)
+        sys.exit(EXIT_MODEL_NOT_FOUND)
+    print(json.dumps(info))
+
+
+if __name__ == "__main__":
+    main()
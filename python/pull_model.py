@@ -5,6 +5,7 @@ import requests
 import argparse
 import json
 import sys
+from OllamaConnection import OllamaConnection
 
 def create_progress_bar(completed, total, bar_length=50):
     """
@@ -26,7 +27,7 @@ def create_progress_bar(completed, total, bar_length=50):
     # I still prefer MB, but I'm sure sombody would complain if I don't use MiB...
     return f"[{bar}] {percent}% ({completed}/{total} MiB)"
 
-def pull_model(base_url, model_name):
+def pull_model(base_url, model_name, connection):
     url = f"{base_url}/api/pull"
 
     # Data to be sent in the POST request
@@ -37,7 +38,8 @@ def pull_model(base_url, model_name):
 
     try:
         # Send POST request with streaming enabled
-        with requests.post(url, json=data, stream=True) as response:
+        with requests.post(url, json=data, stream=True, headers=connection.headers(),
+                           verify=connection.verify(), timeout=connection.timeout()) as response:
             # Check if the response status code is 200 (OK)
             if response.status_code == 200:
                 print(f"Loading {model_name} ...", flush=True)
@@ -82,12 +84,13 @@ def main():
     parser = argparse.ArgumentParser(description="Pull an Ollama model")
     parser.add_argument('-u', '--url', type=str, default="http://localhost:11434", help="Base URL of the Ollama API")
     parser.add_argument('-m', '--model', type=str, required=True, help="Name of the model to pull")
+    OllamaConnection.add_arguments(parser)
 
     # Parse arguments
     args = parser.parse_args()
 
     # Call the function with the provided base URL and model name
-    pull_model(args.url, args.model)
+    pull_model(args.url, args.model, OllamaConnection.from_args(args))
 
 if __name__ == "__main__":
     main()
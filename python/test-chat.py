@@ -0,0 +1,108 @@
+#!/usr/bin/env python3
+# SPDX-License-Identifier: GPL-3.0-or-later
+# SPDX-CopyrightText: 2025 Gerhard Gappmeier <gappy1502@gmx.net>
+#
+# Tests the Ollama chat requests of chat.py without a server: the HTTP
+# requests are answered by httpx.MockTransport.
+#
+# Usage:
+#   ./test-chat.py
+import asyncio
+import contextlib
+import io
+import json
+import logging
+import unittest
+from unittest import mock
+
+import httpx
+
+import chat
+from OllamaConnection import OllamaConnection
+from OllamaCredentials import OllamaCredentials
+
+ENDPOINT = "http://ollama.test:11434/api/chat"
+MODEL = "llama3"
+
+
+def ndjson(*messages):
+    """Returns the body of a streamed Ollama response."""
+    return "".join(json.dumps(message) + "\n" for message in messages).encode()
+
+
+class ChatTest(unittest.TestCase):
+    def setUp(self):
+        chat.log = logging.getLogger("test-chat")
+        chat.log.addHandler(logging.NullHandler())
+        chat.connection = OllamaConnection()
+        # the requests received by the mock server
+        self.requests = []
+
+    def run_chat(self, handler):
+        """Sends one user message, returns the printed output and the messages."""
+        def record(request):
+            self.requests.append(request)
+            return handler(request)
+        messages = [{"role": "system", "content": "Be brief."},
+                    {"role": "user", "content": "Hello"}]
+        output = io.StringIO()
+
+        async def send():
+            async with httpx.AsyncClient(transport=httpx.MockTransport(record)) as client:
+                await chat.stream_chat_message_ollama(client, messages, ENDPOINT, MODEL, {})
+        with contextlib.redirect_stdout(output):
+            asyncio.run(send())
+        return output.getvalue(), messages
+
+    def test_streamed_response(self):
+        def handler(request):
+            self.assertEqual(request.url.path, "/api/chat")
+            return httpx.Response(200, content=ndjson(
+                {"message": {"role": "assistant", "content": "Hi, "}, "done": False},
+                {"message": {"role": "assistant", "content": "how can I help?"}, "done": False},
+                {"message": {"role": "assistant", "content": ""}, "done": True}))
+
+        output, messages = self.run_chat(handler)
+        self.assertEqual(output, "Hi, how can I help?" + chat.end_of_text + "\n")
+        self.assertEqual(messages[-1], {"role": "assistant", "content": "Hi, how can I help?"})
+        self.assertEqual(len(self.requests), 1)
+        data = json.loads(self.requests[0].content)
+        self.assertEqual(data["model"], MODEL)
+        self.assertEqual(data["messages"][1]["content"], "Hello")
+
+    def test_fallback_to_generate(self):
+        def handler(request):
+            if request.url.path == "/api/chat":
+                # old Ollama versions don't know the endpoint
+                return httpx.Response(404, text="404 page not found")
+            self.assertEqual(request.url.path, "/api/generate")
+            return httpx.Response(200, json={"response": "Hi there!", "done": True})
+
+        with mock.patch.object(OllamaCredentials, "GetOllamaToken", return_value="secret"):
+            chat.connection = OllamaConnection(auth="bearer")
+            output, messages = self.run_chat(handler)
+        self.assertIn("Falling back to /api/generate", output)
+        self.assertTrue(output.endswith("Hi there!" + chat.end_of_text + "\n"))
+        self.assertEqual(messages[-1], {"role": "assistant", "content": "Hi there!"})
+        self.assertEqual([r.url.path for r in self.requests], ["/api/chat", "/api/generate"])
+        data = json.loads(self.requests[1].content)
+        self.assertEqual(data["system"], "Be brief.")
+        self.assertEqual(data["prompt"], "user: Hello\n\nassistant: ")
+        # both requests are authenticated
+        for request in self.requests:
+            self.assertEqual(request.headers["Authorization"], "Bearer secret")
+
+    def test_model_not_found(self):
+        def handler(request):
+            return httpx.Response(404, json={"error": f"model '{MODEL}' not found"})
+
+        output, messages = self.run_chat(handler)
+        # no fallback, the error ends the response
+        self.assertEqual(len(self.requests), 1)
+        self.assertIn(chat.error_marker + "An error occurred: Error: model", output)
+        self.assertTrue(output.endswith(chat.end_of_text + "\n"))
+        self.assertEqual(messages[-1]["role"], "user")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,104 @@
+#!/usr/bin/env python3
+# SPDX-License-Identifier: GPL-3.0-or-later
+# SPDX-CopyrightText: 2025 Gerhard Gappmeier <gappy1502@gmx.net>
+#
+# Tests the fallback of complete.py for models without FIM config: the
+# Ollama template decides if the suffix is used or if only the prefix is
+# completed. The Ollama server is mocked.
+#
+# Usage:
+#   ./test-fim-support.py
+import json
+import logging
+import unittest
+from unittest import mock
+
+import complete
+
+BASEURL = "http://ollama.test:11434"
+MODEL = "some-model:1b"
+PROMPT = "def add(a, b):\n    <FILL_IN_HERE>\n\nprint(add(1, 2))\n"
+
+FIM_TEMPLATE = "{{- if .Suffix }}<|fim_prefix|>{{ .Prompt }}<|fim_suffix|>{{ .Suffix }}<|fim_middle|>{{- else }}{{ .Prompt }}{{- end }}"
+CHAT_TEMPLATE = "{{- range .Messages }}<|{{ .Role }}|>{{ .Content }}{{- end }}<|assistant|>"
+
+
+class Response:
+    def __init__(self, status_code, data):
+        self.status_code = status_code
+        self.text = json.dumps(data)
+
+    def json(self):
+        return json.loads(self.text)
+
+
+class FimSupportTest(unittest.TestCase):
+    def setUp(self):
+        complete.log = logging.getLogger("test-fim-support")
+        complete.log.addHandler(logging.NullHandler())
+        # the requests received by the mock server
+        self.requests = []
+
+    def mock_server(self, template):
+        """Returns a mock of OllamaConnection.request for a model with the template."""
+        def request(method, url, **kwargs):
+            self.requests.append((url, kwargs.get('json')))
+            if url.endswith("/api/show"):
+                return Response(200, {'template': template, 'parameters': '', 'model_info': {}})
+            if url.endswith("/api/generate"):
+                return Response(200, {'response': "return a + b", 'done': True})
+            return Response(404, {'error': "404 page not found"})
+        return mock.patch.object(complete.connection, 'request', side_effect=request)
+
+    def complete(self, template, suffix_hint=False):
+        """Runs the fallback like complete.py, returns the FIM decision and the request."""
+        with self.mock_server(template):
+            fim = complete.model_supports_suffix(complete.get_model_info(BASEURL, MODEL))
+            completion = complete.generate_code_completion(None, PROMPT, BASEURL, MODEL, {},
+                                                           fim, suffix_hint)
+        self.assertEqual(completion, "return a + b")
+        url, data = self.requests[-1]
+        self.assertEqual(url, BASEURL + "/api/generate")
+        return fim, data
+
+    def test_template_with_suffix(self):
+        fim, data = self.complete(FIM_TEMPLATE)
+        self.assertTrue(fim)
+        # Ollama's template builds the FIM prompt from prompt and suffix
+        self.assertEqual(data['prompt'], "def add(a, b):\n    ")
+        self.assertEqual(data['suffix'], "\n\nprint(add(1, 2))\n")
+        self.assertFalse(data['raw'])
+
+    def test_template_without_suffix(self):
+        fim, data = self.complete(CHAT_TEMPLATE)
+        self.assertFalse(fim)
+        # only the code before the cursor gets completed
+        self.assertEqual(data['prompt'], "def add(a, b):\n    ")
+        self.assertNotIn('suffix', data)
+        self.assertTrue(data['raw'])
+
+    def test_template_without_suffix_hint(self):
+        fim, data = self.complete(CHAT_TEMPLATE, suffix_hint=True)
+        self.assertFalse(fim)
+        self.assertEqual(data['prompt'], complete.prefix_only_prompt(PROMPT, True))
+        self.assertTrue(data['prompt'].startswith("Code after the cursor:\n\n\nprint(add(1, 2))\n"))
+        self.assertTrue(data['prompt'].endswith("Code before the cursor:\ndef add(a, b):\n    "))
+        self.assertNotIn('suffix', data)
+
+    def test_model_info_from_vim(self):
+        info = {'suffix': False, 'context_length': 4096, 'num_ctx': None}
+        with self.mock_server(FIM_TEMPLATE):
+            # the info given by Vim is used without asking Ollama
+            self.assertFalse(complete.model_supports_suffix(complete.get_model_info(BASEURL, MODEL, info)))
+        self.assertEqual(self.requests, [])
+
+    def test_model_not_found(self):
+        def request(method, url, **kwargs):
+            return Response(404, {'error': f"model '{MODEL}' not found"})
+        with mock.patch.object(complete.connection, 'request', side_effect=request):
+            with self.assertRaises(complete.ModelNotFoundError):
+                complete.get_model_info(BASEURL, MODEL)
+
+
+if __name__ == "__main__":
+    unittest.main()